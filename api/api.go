@@ -13,6 +13,7 @@ import (
 	nanoauth "github.com/nanobox-io/golang-nanoauth"
 
 	"github.com/nanopack/shaman/config"
+	"github.com/nanopack/shaman/metrics"
 )
 
 type (
@@ -28,6 +29,9 @@ var (
 	auth            nanoauth.Auth
 	errBadJson      = errors.New("Bad JSON syntax received in body")
 	errBodyReadFail = errors.New("Body Read Failed")
+
+	// unauthenticated are the routes that don't require the auth token
+	unauthenticated = []string{"/dns-query"}
 )
 
 // Start starts shaman's http api
@@ -37,7 +41,7 @@ func Start() error {
 	// handle config.Insecure
 	if config.Insecure {
 		config.Log.Info("Shaman listening at http://%s...", config.ApiListen)
-		return fmt.Errorf("API stopped - %v", auth.ListenAndServe(config.ApiListen, config.ApiToken, routes()))
+		return fmt.Errorf("API stopped - %v", auth.ListenAndServe(config.ApiListen, config.ApiToken, countRequests(routes()), unauthenticated...))
 	}
 
 	var cert *tls.Certificate
@@ -55,7 +59,7 @@ func Start() error {
 
 	config.Log.Info("Shaman listening at https://%v", config.ApiListen)
 
-	return fmt.Errorf("API stopped - %v", auth.ListenAndServeTLS(config.ApiListen, config.ApiToken, routes()))
+	return fmt.Errorf("API stopped - %v", auth.ListenAndServeTLS(config.ApiListen, config.ApiToken, countRequests(routes()), unauthenticated...))
 }
 
 func routes() *pat.Router {
@@ -69,6 +73,26 @@ func routes() *pat.Router {
 	router.Get("/records", listRecords)   // return all domains
 	router.Put("/records", updateAnswers) // reset all resources
 
+	router.Get("/dns-query", dnsQuery)  // DNS-over-HTTPS (RFC 8484)
+	router.Post("/dns-query", dnsQuery) // DNS-over-HTTPS (RFC 8484)
+
+	router.Delete("/cache", flushCache) // flush the fallback response cache
+	router.Get("/cache", getCacheStats) // return fallback response cache stats
+
+	router.Delete("/views/{view}/{domain}", removeFromView) // stop the resource being seen from the view
+	router.Put("/views/{view}/{domain}", addToView)         // have the resource seen from the view
+
+	router.Get("/views/{view}", getViewRecords) // return resources as answered in the view
+	router.Get("/views", listViews)             // return views and their domains
+
+	router.Get("/health", getHealth)            // return health checked records' state
+	router.Get("/ratelimit", getRateLimitStats) // return rate limiting counters
+
+	router.Put("/querylog", setQueryLog) // turn the query log on or off
+	router.Get("/querylog", getQueryLog) // return the query log's state
+
+	router.Get("/metrics", metrics.Handler) // return prometheus metrics
+
 	return router
 }
 
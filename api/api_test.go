@@ -3,6 +3,7 @@ package api_test
 import (
 	"bytes"
 	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -13,10 +14,12 @@ import (
 	"time"
 
 	"github.com/jcelliott/lumber"
+	"github.com/miekg/dns"
 
 	"github.com/nanopack/shaman/api"
 	"github.com/nanopack/shaman/config"
 	shaman "github.com/nanopack/shaman/core/common"
+	"github.com/nanopack/shaman/server"
 )
 
 var (
@@ -50,13 +53,13 @@ func TestPutRecords(t *testing.T) {
 	json.Unmarshal(resp, &resources)
 
 	if len(resources) != 1 {
-		t.Errorf("%q doesn't match expected out", resources)
+		t.Errorf("%+v doesn't match expected out", resources)
 	}
 
 	if len(resources) == 1 &&
 		len(resources[0].Records) == 1 &&
 		resources[0].Records[0].Address != "127.0.0.1" {
-		t.Errorf("%q doesn't match expected out", resources)
+		t.Errorf("%+v doesn't match expected out", resources)
 	}
 
 	// bad request test
@@ -104,7 +107,7 @@ func TestPostRecord(t *testing.T) {
 	json.Unmarshal(resp, &resource)
 
 	if resource.Domain != "google.com." {
-		t.Errorf("%q doesn't match expected out", resource)
+		t.Errorf("%+v doesn't match expected out", resource)
 	}
 
 	// bad request test
@@ -116,6 +119,17 @@ func TestPostRecord(t *testing.T) {
 	if !strings.Contains(string(resp), "Bad JSON syntax received in body") {
 		t.Errorf("%q doesn't match expected out", resp)
 	}
+
+	// bad answer policies
+	for _, bad := range []string{`"policy":"weigthed"`, `"policy":"top","answers":-1`} {
+		resp, code, err := rest("POST", "/records", fmt.Sprintf(`{"domain":"policy.test","records":[{"address":"127.0.0.1"}],%s}`, bad))
+		if err != nil {
+			t.Error(err)
+		}
+		if code != 400 {
+			t.Errorf("Expected 400 for %s, got %d - %q", bad, code, resp)
+		}
+	}
 }
 
 // test get resource
@@ -130,7 +144,7 @@ func TestGetRecord(t *testing.T) {
 	json.Unmarshal(resp, &resource)
 
 	if resource.Domain != "google.com." {
-		t.Errorf("%q doesn't match expected out", resource)
+		t.Errorf("%+v doesn't match expected out", resource)
 	}
 
 	// bad request test
@@ -160,7 +174,7 @@ func TestPutRecord(t *testing.T) {
 
 	if len(resource.Records) == 1 &&
 		resource.Records[0].Address != "127.0.0.4" {
-		t.Errorf("%q doesn't match expected out", resource)
+		t.Errorf("%+v doesn't match expected out", resource)
 	}
 
 	// good request test - update
@@ -223,6 +237,236 @@ func TestDeleteRecord(t *testing.T) {
 	}
 }
 
+// test fallback cache stats and flush
+func TestCache(t *testing.T) {
+	body, _, err := rest("GET", "/cache", "")
+	if err != nil {
+		t.Error(err)
+	}
+
+	var stats server.CacheStats
+	err = json.Unmarshal(body, &stats)
+	if err != nil {
+		t.Errorf("%q doesn't match expected out - %v", body, err)
+	}
+
+	body, _, err = rest("DELETE", "/cache", "")
+	if err != nil {
+		t.Error(err)
+	}
+
+	if !strings.Contains(string(body), "{\"msg\":\"success\"}") {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+}
+
+// test views
+func TestViews(t *testing.T) {
+	body, _, err := rest("GET", "/views", "")
+	if err != nil {
+		t.Error(err)
+	}
+
+	var views []server.View
+	err = json.Unmarshal(body, &views)
+	if err != nil {
+		t.Errorf("%q doesn't match expected out - %v", body, err)
+	}
+
+	body, _, err = rest("GET", "/views/internal", "")
+	if err != nil {
+		t.Error(err)
+	}
+
+	var resources []shaman.Resource
+	err = json.Unmarshal(body, &resources)
+	if err != nil {
+		t.Errorf("%q doesn't match expected out - %v", body, err)
+	}
+
+	// scoping resources to views
+	rest("POST", "/records", testResource1)
+	var resource shaman.Resource
+	for _, step := range []struct {
+		method string
+		view   string
+		status int
+		views  string
+	}{
+		{"PUT", "internal", 200, "[internal]"},
+		{"PUT", "Internal", 200, "[internal]"}, // already there
+		{"PUT", "external", 200, "[internal external]"},
+		{"DELETE", "internal", 200, "[external]"},
+		{"DELETE", "external", 400, "[external]"}, // would be seen from every view
+	} {
+		body, status, err := rest(step.method, "/views/"+step.view+"/google.com", "")
+		if err != nil {
+			t.Error(err)
+		}
+		if status != step.status {
+			t.Errorf("Expected %d for %s %s, got %d - %q", step.status, step.method, step.view, status, body)
+		}
+		body, _, _ = rest("GET", "/records/google.com", "")
+		json.Unmarshal(body, &resource)
+		if fmt.Sprint(resource.Views) != step.views {
+			t.Errorf("Expected views %s after %s %s, got %v", step.views, step.method, step.view, resource.Views)
+		}
+	}
+
+	body, status, err := rest("PUT", "/views/internal/missing.com", "")
+	if err != nil {
+		t.Error(err)
+	}
+	if status != 404 {
+		t.Errorf("Expected 404 for a missing domain, got %d - %q", status, body)
+	}
+
+	rest("PUT", "/records", "[]")
+}
+
+// test health checked records' state
+func TestHealth(t *testing.T) {
+	body, _, err := rest("GET", "/health", "")
+	if err != nil {
+		t.Error(err)
+	}
+
+	var statuses []server.HealthStatus
+	err = json.Unmarshal(body, &statuses)
+	if err != nil {
+		t.Errorf("%q doesn't match expected out - %v", body, err)
+	}
+}
+
+// test rate limiting counters
+func TestRateLimit(t *testing.T) {
+	body, _, err := rest("GET", "/ratelimit", "")
+	if err != nil {
+		t.Error(err)
+	}
+
+	var stats server.RateLimitStats
+	err = json.Unmarshal(body, &stats)
+	if err != nil {
+		t.Errorf("%q doesn't match expected out - %v", body, err)
+	}
+}
+
+// test toggling the query log
+func TestQueryLog(t *testing.T) {
+	// only the configured sinks can be logged to
+	body, status, err := rest("PUT", "/querylog", `{"enabled":true,"sinks":["file:///tmp/shaman-queries.log"]}`)
+	if err != nil {
+		t.Error(err)
+	}
+	if status != 400 {
+		t.Errorf("Expected a sink that isn't configured to be rejected, got %d - %q", status, body)
+	}
+	if _, err := os.Stat("/tmp/shaman-queries.log"); err == nil {
+		t.Errorf("Expected a sink that isn't configured to be left alone")
+	}
+
+	body, status, err = rest("PUT", "/querylog", `{"enabled":false}`)
+	if err != nil {
+		t.Error(err)
+	}
+	if status != 200 {
+		t.Errorf("Failed to disable query log, got %d - %q", status, body)
+	}
+
+	body, _, err = rest("GET", "/querylog", "")
+	if err != nil {
+		t.Error(err)
+	}
+
+	var log server.QueryLogStatus
+	err = json.Unmarshal(body, &log)
+	if err != nil {
+		t.Errorf("%q doesn't match expected out - %v", body, err)
+	}
+	if log.Enabled {
+		t.Errorf("Expected the query log to be disabled - %q", body)
+	}
+}
+
+// test prometheus metrics
+func TestMetrics(t *testing.T) {
+	rest("PUT", "/records", fmt.Sprintf("[%v]", testResource1))
+	defer rest("PUT", "/records", "[]")
+	rest("GET", "/records/google.com", "")
+
+	body, _, err := rest("GET", "/metrics", "")
+	if err != nil {
+		t.Error(err)
+	}
+	for _, expected := range []string{
+		`shaman_api_requests_total{method="GET",route="/records/{domain}",status="200"}`,
+		`shaman_api_requests_total{method="PUT",route="/records",status="200"}`,
+		"shaman_domains 1",
+		"shaman_records 1",
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("Expected %q in metrics - %q", expected, body)
+		}
+	}
+}
+
+// test DNS-over-HTTPS
+func TestDnsQuery(t *testing.T) {
+	rest("PUT", "/records", fmt.Sprintf("[%v]", testResource1))
+	defer rest("PUT", "/records", "[]")
+
+	m := new(dns.Msg)
+	m.SetQuestion("google.com.", dns.TypeA)
+	m.Id = 0
+	b, _ := m.Pack()
+
+	// no auth token required
+	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	get := fmt.Sprintf("https://%s/dns-query?dns=%s", config.ApiListen, base64.RawURLEncoding.EncodeToString(b))
+	post := fmt.Sprintf("https://%s/dns-query", config.ApiListen)
+
+	for _, method := range []string{"GET", "POST"} {
+		var res *http.Response
+		var err error
+		if method == "GET" {
+			res, err = http.Get(get)
+		} else {
+			res, err = http.Post(post, "application/dns-message", bytes.NewReader(b))
+		}
+		if err != nil {
+			t.Errorf("Unable to %v /dns-query - %v", method, err)
+			continue
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		if res.StatusCode != 200 || res.Header.Get("Content-Type") != "application/dns-message" {
+			t.Errorf("%v /dns-query: unexpected response %d %q", method, res.StatusCode, res.Header.Get("Content-Type"))
+			continue
+		}
+
+		r := new(dns.Msg)
+		if err := r.Unpack(body); err != nil {
+			t.Errorf("%v /dns-query: bad dns message - %v", method, err)
+			continue
+		}
+		if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "127.0.0.1" {
+			t.Errorf("%v /dns-query: %v doesn't match expected out", method, r.Answer)
+		}
+	}
+
+	// bad requests
+	res, err := http.Post(post, "application/json", bytes.NewReader(b))
+	if err != nil || res.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected 415 for wrong content type - %v", err)
+	}
+	res, err = http.Get(post + "?dns=bad")
+	if err != nil || res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for bad message - %v", err)
+	}
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 // PRIVS
 ////////////////////////////////////////////////////////////////////////////////
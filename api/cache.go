@@ -0,0 +1,16 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/nanopack/shaman/server"
+)
+
+func getCacheStats(rw http.ResponseWriter, req *http.Request) {
+	writeBody(rw, req, server.GetCacheStats(), http.StatusOK)
+}
+
+func flushCache(rw http.ResponseWriter, req *http.Request) {
+	server.FlushCache()
+	writeBody(rw, req, apiMsg{"success"}, http.StatusOK)
+}
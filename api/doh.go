@@ -0,0 +1,132 @@
+package api
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/nanopack/shaman/config"
+	"github.com/nanopack/shaman/server"
+)
+
+var (
+	errBadDnsMessage  = errors.New("Bad DNS message received")
+	errBadContentType = errors.New("Content-Type must be application/dns-message")
+)
+
+// dnsQuery answers DNS-over-HTTPS requests (RFC 8484), either a GET with the
+// base64url encoded message in the `dns` param, or a POST of the raw message
+func dnsQuery(rw http.ResponseWriter, req *http.Request) {
+	var b []byte
+	var err error
+
+	switch req.Method {
+	case "GET":
+		b, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(req.URL.Query().Get("dns"), "="))
+	case "POST":
+		if req.Header.Get("Content-Type") != "application/dns-message" {
+			writeBody(rw, req, apiError{errBadContentType.Error()}, http.StatusUnsupportedMediaType)
+			return
+		}
+		b, err = ioutil.ReadAll(io.LimitReader(req.Body, dns.MaxMsgSize))
+		defer req.Body.Close()
+	}
+	if err != nil {
+		writeBody(rw, req, apiError{errBadDnsMessage.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	msg := new(dns.Msg)
+	if err = msg.Unpack(b); err != nil || len(msg.Question) == 0 {
+		writeBody(rw, req, apiError{errBadDnsMessage.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	res := &dohWriter{remote: remoteAddr(req)}
+	server.ServeDNS(res, msg)
+	if res.msg == nil {
+		writeBody(rw, req, apiError{"No response"}, http.StatusInternalServerError)
+		return
+	}
+
+	out, err := res.msg.Pack()
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	config.Log.Debug("%s %d %s %s %s", req.RemoteAddr, http.StatusOK, req.Method, req.URL.Path, msg.Question[0].Name)
+
+	rw.Header().Set("Content-Type", "application/dns-message")
+	rw.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", minTTL(res.msg)))
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(out)
+}
+
+// minTTL returns the lowest ttl in the response, for http caching
+func minTTL(msg *dns.Msg) uint32 {
+	ttl := uint32(0)
+	first := true
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns} {
+		for _, rr := range section {
+			if first || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				first = false
+			}
+		}
+	}
+	return ttl
+}
+
+// remoteAddr returns the http client's address
+func remoteAddr(req *http.Request) net.Addr {
+	host, port, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return addr
+}
+
+// dohWriter is a dns.ResponseWriter that holds on to the response so it can
+// be sent back over http
+type dohWriter struct {
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (self *dohWriter) LocalAddr() net.Addr {
+	addr, _ := net.ResolveTCPAddr("tcp", config.ApiListen)
+	return addr
+}
+
+func (self *dohWriter) RemoteAddr() net.Addr {
+	return self.remote
+}
+
+func (self *dohWriter) WriteMsg(msg *dns.Msg) error {
+	self.msg = msg
+	return nil
+}
+
+func (self *dohWriter) Write(b []byte) (int, error) {
+	self.msg = new(dns.Msg)
+	return len(b), self.msg.Unpack(b)
+}
+
+// signed requests aren't verified over https, so are never trusted
+func (self *dohWriter) TsigStatus() error { return dns.ErrSecret }
+
+func (self *dohWriter) Close() error        { return nil }
+func (self *dohWriter) TsigTimersOnly(bool) {}
+func (self *dohWriter) Hijack()             {}
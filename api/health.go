@@ -0,0 +1,11 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/nanopack/shaman/server"
+)
+
+func getHealth(rw http.ResponseWriter, req *http.Request) {
+	writeBody(rw, req, server.GetHealth(), http.StatusOK)
+}
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/pat"
+
+	"github.com/nanopack/shaman/metrics"
+)
+
+var apiRequests = metrics.NewCounterVec("shaman_api_requests_total",
+	"Api requests, by method, route and response status", "method", "route", "status")
+
+// statusRecorder remembers the status a response was written with
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (self *statusRecorder) WriteHeader(status int) {
+	self.status = status
+	self.ResponseWriter.WriteHeader(status)
+}
+
+// countRequests counts the requests the router serves, by the route they
+// matched (not their path, which would make a series per domain)
+func countRequests(router *pat.Router) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		route := "unmatched"
+		var match mux.RouteMatch
+		if router.Match(req, &match) && match.Route != nil {
+			if template, err := match.Route.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+
+		recorder := &statusRecorder{ResponseWriter: rw, status: http.StatusOK}
+		router.ServeHTTP(recorder, req)
+		apiRequests.Inc(req.Method, route, strconv.Itoa(recorder.status))
+	})
+}
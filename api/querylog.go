@@ -0,0 +1,35 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/nanopack/shaman/server"
+)
+
+// queryLogToggle turns the query log on or off, optionally logging to only some
+// of the configured sinks
+type queryLogToggle struct {
+	Enabled bool     `json:"enabled"`
+	Sinks   []string `json:"sinks"`
+}
+
+func getQueryLog(rw http.ResponseWriter, req *http.Request) {
+	writeBody(rw, req, server.GetQueryLog(), http.StatusOK)
+}
+
+func setQueryLog(rw http.ResponseWriter, req *http.Request) {
+	var toggle queryLogToggle
+	err := parseBody(req, &toggle)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	err = server.SetQueryLog(toggle.Enabled, toggle.Sinks)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	writeBody(rw, req, server.GetQueryLog(), http.StatusOK)
+}
@@ -11,6 +11,9 @@ import (
 func createRecord(rw http.ResponseWriter, req *http.Request) {
 	var resource sham.Resource
 	err := parseBody(req, &resource)
+	if err == nil {
+		err = resource.Validate()
+	}
 	if err != nil {
 		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
 		return
@@ -37,6 +40,9 @@ func listRecords(rw http.ResponseWriter, req *http.Request) {
 func updateAnswers(rw http.ResponseWriter, req *http.Request) {
 	resources := make([]sham.Resource, 0)
 	err := parseBody(req, &resources)
+	for i := 0; err == nil && i < len(resources); i++ {
+		err = resources[i].Validate()
+	}
 	if err != nil {
 		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
 		return
@@ -54,6 +60,9 @@ func updateAnswers(rw http.ResponseWriter, req *http.Request) {
 func updateRecord(rw http.ResponseWriter, req *http.Request) {
 	var resource sham.Resource
 	err := parseBody(req, &resource)
+	if err == nil {
+		err = resource.Validate()
+	}
 	if err != nil {
 		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
 		return
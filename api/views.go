@@ -0,0 +1,82 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/nanopack/shaman/core"
+	"github.com/nanopack/shaman/server"
+)
+
+func listViews(rw http.ResponseWriter, req *http.Request) {
+	writeBody(rw, req, server.GetViews(), http.StatusOK)
+}
+
+func getViewRecords(rw http.ResponseWriter, req *http.Request) {
+	writeBody(rw, req, server.GetViewRecords(req.URL.Query().Get(":view")), http.StatusOK)
+}
+
+func addToView(rw http.ResponseWriter, req *http.Request) {
+	domain := req.URL.Query().Get(":domain")
+	view := strings.ToLower(req.URL.Query().Get(":view"))
+
+	resource, err := shaman.GetRecord(domain)
+	if err != nil {
+		writeBody(rw, req, apiError{fmt.Sprintf("failed to find record for domain - '%v'", domain)}, http.StatusNotFound)
+		return
+	}
+
+	for i := range resource.Views {
+		if strings.EqualFold(strings.TrimSpace(resource.Views[i]), view) {
+			writeBody(rw, req, resource, http.StatusOK)
+			return
+		}
+	}
+	// copied, so the stored resource is left alone
+	resource.Views = append(append(make([]string, 0, len(resource.Views)+1), resource.Views...), view)
+
+	err = shaman.UpdateRecord(domain, &resource)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	writeBody(rw, req, resource, http.StatusOK)
+}
+
+func removeFromView(rw http.ResponseWriter, req *http.Request) {
+	domain := req.URL.Query().Get(":domain")
+	view := strings.ToLower(req.URL.Query().Get(":view"))
+
+	resource, err := shaman.GetRecord(domain)
+	if err != nil {
+		writeBody(rw, req, apiError{fmt.Sprintf("failed to find record for domain - '%v'", domain)}, http.StatusNotFound)
+		return
+	}
+
+	views := make([]string, 0, len(resource.Views))
+	for i := range resource.Views {
+		if !strings.EqualFold(strings.TrimSpace(resource.Views[i]), view) {
+			views = append(views, resource.Views[i])
+		}
+	}
+	if len(views) == len(resource.Views) {
+		writeBody(rw, req, resource, http.StatusOK)
+		return
+	}
+	// a domain in no views is seen from all of them
+	if len(views) == 0 {
+		writeBody(rw, req, apiError{fmt.Sprintf("'%v' is only in view '%v' - add it to another first", domain, view)}, http.StatusBadRequest)
+		return
+	}
+	resource.Views = views
+
+	err = shaman.UpdateRecord(domain, &resource)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	writeBody(rw, req, resource, http.StatusOK)
+}
@@ -5,14 +5,22 @@ import (
 	"errors"
 	"fmt"
 	"net/url"
+	"time"
 
 	"github.com/nanopack/shaman/config"
 	shaman "github.com/nanopack/shaman/core/common"
+	"github.com/nanopack/shaman/metrics"
 )
 
 var (
 	storage          cacher
+	backend          string // storage's name, for metrics
 	errNoRecordError = errors.New("No Record Found")
+
+	operationDuration = metrics.NewHistogramVec("shaman_cache_operation_duration_seconds",
+		"Time persistent cache operations took, by backend and operation", metrics.DefaultBuckets, "backend", "operation")
+	operationErrors = metrics.NewCounterVec("shaman_cache_errors_total",
+		"Persistent cache operations that failed, by backend and operation", "backend", "operation")
 )
 
 // The cacher interface is what all the backends [will] implement
@@ -35,17 +43,17 @@ func Initialize() error {
 
 	switch u.Scheme {
 	case "scribble":
-		storage = &scribbleDb{}
+		storage, backend = &scribbleDb{}, "scribble"
 	case "postgres":
-		storage = &postgresDb{}
+		storage, backend = &postgresDb{}, "postgres"
 	case "postgresql":
-		storage = &postgresDb{}
+		storage, backend = &postgresDb{}, "postgres"
 	case "consul":
-		storage = &consulDb{}
+		storage, backend = &consulDb{}, "consul"
 	case "none":
 		storage = nil
 	default:
-		storage = &scribbleDb{}
+		storage, backend = &scribbleDb{}, "scribble"
 	}
 
 	if storage != nil {
@@ -61,48 +69,53 @@ func Initialize() error {
 }
 
 // AddRecord adds a record to the persistent cache
-func AddRecord(resource *shaman.Resource) error {
+func AddRecord(resource *shaman.Resource) (err error) {
 	if storage == nil {
 		return nil
 	}
+	defer observe("add", time.Now(), &err)
 	resource.Validate()
 	return storage.addRecord(*resource)
 }
 
 // GetRecord gets a record to the persistent cache
-func GetRecord(domain string) (*shaman.Resource, error) {
+func GetRecord(domain string) (resource *shaman.Resource, err error) {
 	if storage == nil {
 		return nil, nil
 	}
+	defer observe("get", time.Now(), &err)
 
 	shaman.SanitizeDomain(&domain)
 	return storage.getRecord(domain)
 }
 
 // UpdateRecord updates a record in the persistent cache
-func UpdateRecord(domain string, resource *shaman.Resource) error {
+func UpdateRecord(domain string, resource *shaman.Resource) (err error) {
 	if storage == nil {
 		return nil
 	}
+	defer observe("update", time.Now(), &err)
 	shaman.SanitizeDomain(&domain)
 	resource.Validate()
 	return storage.updateRecord(domain, *resource)
 }
 
 // DeleteRecord removes a record from the persistent cache
-func DeleteRecord(domain string) error {
+func DeleteRecord(domain string) (err error) {
 	if storage == nil {
 		return nil
 	}
+	defer observe("delete", time.Now(), &err)
 	shaman.SanitizeDomain(&domain)
 	return storage.deleteRecord(domain)
 }
 
 // ResetRecords replaces all records in the persistent cache
-func ResetRecords(resources *[]shaman.Resource) error {
+func ResetRecords(resources *[]shaman.Resource) (err error) {
 	if storage == nil {
 		return nil
 	}
+	defer observe("reset", time.Now(), &err)
 	for i := range *resources {
 		(*resources)[i].Validate()
 	}
@@ -111,13 +124,23 @@ func ResetRecords(resources *[]shaman.Resource) error {
 }
 
 // ListRecords lists all records in the persistent cache
-func ListRecords() ([]shaman.Resource, error) {
+func ListRecords() (resources []shaman.Resource, err error) {
 	if storage == nil {
 		return make([]shaman.Resource, 0), nil
 	}
+	defer observe("list", time.Now(), &err)
 	return storage.listRecords()
 }
 
+// observe records how long an operation since start took, and whether it failed
+// (a record not being found isn't a failure)
+func observe(operation string, start time.Time, err *error) {
+	operationDuration.Observe(time.Since(start).Seconds(), backend, operation)
+	if *err != nil && *err != errNoRecordError {
+		operationErrors.Inc(backend, operation)
+	}
+}
+
 // Exists returns whether the default cacher exists
 func Exists() bool {
 	return storage != nil
@@ -2,7 +2,9 @@ package cache
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"strings"
 
 	_ "github.com/lib/pq"
 
@@ -38,12 +40,27 @@ CREATE TABLE IF NOT EXISTS records (
 	address  TEXT NOT NULL,
 	ttl      INTEGER,
 	class    TEXT,
-	type     TEXT
+	type     TEXT,
+	subnets  TEXT,
+	weight   INTEGER,
+	policy   TEXT,
+	answers  INTEGER,
+	health   TEXT,
+	views    TEXT,
+	domain_views TEXT
 )`)
 	if err != nil {
 		return fmt.Errorf("Failed to create records table - %v", err)
 	}
 
+	// tables created before records had these
+	for _, column := range []string{"subnets TEXT", "weight INTEGER", "policy TEXT", "answers INTEGER", "health TEXT", "views TEXT", "domain_views TEXT"} {
+		_, err = p.pg.Exec(fmt.Sprintf(`ALTER TABLE records ADD COLUMN IF NOT EXISTS %v`, column))
+		if err != nil {
+			return fmt.Errorf("Failed to add column to records table - %v", err)
+		}
+	}
+
 	return nil
 }
 
@@ -91,11 +108,22 @@ func (p postgresDb) addRecord(resource shaman.Resource) error {
 	// add records
 	for i := range resource.Records {
 		config.Log.Trace("Adding record to database...")
+		check := ""
+		if resource.Records[i].Check != nil {
+			b, err := json.Marshal(resource.Records[i].Check)
+			if err != nil {
+				return fmt.Errorf("Failed to marshal health check - %v", err)
+			}
+			check = string(b)
+		}
 		_, err = p.pg.Exec(fmt.Sprintf(`
-INSERT INTO records(domain, address, ttl, class, type)
-VALUES('%v', '%v', '%v', '%v', '%v')`,
+INSERT INTO records(domain, address, ttl, class, type, subnets, weight, policy, answers, health, views, domain_views)
+VALUES('%v', '%v', '%v', '%v', '%v', '%v', '%v', '%v', '%v', '%v', '%v', '%v')`,
 			resource.Domain, resource.Records[i].Address, resource.Records[i].TTL,
-			resource.Records[i].Class, resource.Records[i].RType))
+			resource.Records[i].Class, resource.Records[i].RType,
+			strings.Join(resource.Records[i].Subnets, ","), resource.Records[i].Weight,
+			resource.Policy, resource.Answers, strings.Replace(check, "'", "''", -1),
+			strings.Join(resource.Records[i].Views, ","), strings.Join(resource.Views, ",")))
 		if err != nil {
 			return fmt.Errorf("Failed to insert into records table - %v", err)
 		}
@@ -106,21 +134,37 @@ VALUES('%v', '%v', '%v', '%v', '%v')`,
 
 func (p postgresDb) getRecord(domain string) (*shaman.Resource, error) {
 	// read from records table
-	rows, err := p.pg.Query(fmt.Sprintf("SELECT address, ttl, class, type FROM records WHERE domain = '%v'", domain))
+	rows, err := p.pg.Query(fmt.Sprintf("SELECT address, ttl, class, type, COALESCE(subnets, ''), COALESCE(weight, 0), COALESCE(policy, ''), COALESCE(answers, 0), COALESCE(health, ''), COALESCE(views, ''), COALESCE(domain_views, '') FROM records WHERE domain = '%v'", domain))
 	if err != nil {
 		return nil, fmt.Errorf("Failed to select from records table - %v", err)
 	}
 	defer rows.Close()
 
 	records := make([]shaman.Record, 0, 0)
+	// the answer policy is kept with each record
+	var policy, domainViews string
+	var answers int
 
 	// get data
 	for rows.Next() {
 		rcrd := shaman.Record{}
-		err = rows.Scan(&rcrd.Address, &rcrd.TTL, &rcrd.Class, &rcrd.RType)
+		var subnets, check, views string
+		err = rows.Scan(&rcrd.Address, &rcrd.TTL, &rcrd.Class, &rcrd.RType, &subnets, &rcrd.Weight, &policy, &answers, &check, &views, &domainViews)
 		if err != nil {
 			return nil, fmt.Errorf("Failed to save results into record - %v", err)
 		}
+		if views != "" {
+			rcrd.Views = strings.Split(views, ",")
+		}
+		if check != "" {
+			rcrd.Check = &shaman.Check{}
+			if err = json.Unmarshal([]byte(check), rcrd.Check); err != nil {
+				return nil, fmt.Errorf("Failed to unmarshal health check - %v", err)
+			}
+		}
+		if subnets != "" {
+			rcrd.Subnets = strings.Split(subnets, ",")
+		}
 
 		records = append(records, rcrd)
 	}
@@ -134,7 +178,11 @@ func (p postgresDb) getRecord(domain string) (*shaman.Resource, error) {
 		return nil, errNoRecordError
 	}
 
-	return &shaman.Resource{Domain: domain, Records: records}, nil
+	resource := &shaman.Resource{Domain: domain, Records: records, Policy: policy, Answers: answers}
+	if domainViews != "" {
+		resource.Views = strings.Split(domainViews, ",")
+	}
+	return resource, nil
 }
 
 func (p postgresDb) updateRecord(domain string, resource shaman.Resource) error {
@@ -65,6 +65,7 @@ func init() {
 	DelDomain.Flags().StringVarP(&resource.Domain, "domain", "d", "", "Domain to remove")
 	GetDomain.Flags().StringVarP(&resource.Domain, "domain", "d", "", "Domain to get")
 	ListDomains.Flags().BoolVarP(&full, "full", "f", false, "Show complete records")
+	ListDomains.Flags().StringVar(&view, "view", "", "Show the complete records answered in a view")
 	ResetDomains.Flags().StringVarP(&jsonString, "json", "j", "", "JSON encoded data for domain[s] and record[s]")
 	domainFlags(UpdateDomain)
 }
@@ -74,6 +75,7 @@ var (
 	record     shaman.Record
 	jsonString string
 	full       bool
+	view       string
 )
 
 // ResetVars resets the flag vars (used for testing)
@@ -82,6 +84,7 @@ func ResetVars() {
 	record = shaman.Record{}
 	jsonString = ""
 	full = false
+	view = ""
 }
 
 func domainFlags(ccmd *cobra.Command) {
@@ -90,5 +93,11 @@ func domainFlags(ccmd *cobra.Command) {
 	ccmd.Flags().StringVarP(&record.Class, "class", "C", "IN", "Record class")
 	ccmd.Flags().StringVarP(&record.RType, "type", "R", "A", "Record type (A, CNAME, MX, etc...)")
 	ccmd.Flags().StringVarP(&record.Address, "address", "A", "", "Record address")
+	ccmd.Flags().StringSliceVar(&record.Subnets, "subnets", nil, "Clients the record is for (cidrs or regions, comma separated), everyone if empty")
+	ccmd.Flags().IntVar(&record.Weight, "weight", 0, "Relative chance of the record being answered with, by the answer policy (default 1)")
+	ccmd.Flags().StringVar(&resource.Policy, "policy", "", "How the domain's records are answered [all|shuffle|weighted|top] (default all)")
+	ccmd.Flags().IntVar(&resource.Answers, "answers", 0, "Records of each type answered with the top policy")
+	ccmd.Flags().StringSliceVar(&resource.Views, "domain-view", nil, "Views the domain is seen from (comma separated), every view if empty")
+	ccmd.Flags().StringSliceVar(&record.Views, "view", nil, "Views the record is answered in (comma separated), every view if empty")
 	ccmd.Flags().StringVarP(&jsonString, "json", "j", "", "JSON encoded data for domain[s] and record[s]")
 }
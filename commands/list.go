@@ -19,12 +19,15 @@ var (
 )
 
 func listRecords(ccmd *cobra.Command, args []string) {
-	var query string
+	path := "/records"
 	if full {
-		query = "?full=true"
+		path += "?full=true"
+	}
+	if view != "" {
+		path = fmt.Sprintf("/views/%v", view)
 	}
 
-	res, err := rest("GET", fmt.Sprintf("/records%v", query), nil)
+	res, err := rest("GET", path, nil)
 	if err != nil {
 		fail("Could not contact shaman - %v", err)
 	}
@@ -5,6 +5,8 @@ package config
 import (
 	"fmt"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/jcelliott/lumber"
 	"github.com/spf13/cobra"
@@ -25,6 +27,60 @@ var (
 	DnsListen          = "127.0.0.1:53"              // Listen address for DNS requests (ip:port)
 	DnsFallBack        = ""                          // fallback dns server if record not found in cache, not used if empty
 
+	EdnsUdpSize = 1232 // Largest udp response advertised to (and sent to) EDNS clients
+
+	DnsTlsListen = "" // Listen address for DNS-over-TLS requests (ip[:port], port defaults to 853), disabled if empty
+	DnsTlsCrt    = "" // Path to SSL crt for DNS-over-TLS (defaults to the api's)
+	DnsTlsKey    = "" // Path to (unencrypted) SSL key for DNS-over-TLS (defaults to the api's)
+
+	FallBackPolicy         = "sequential"     // Order fallback dns servers are tried in [sequential|round-robin|fastest]
+	FallBackTimeout        = 2 * time.Second  // Time to wait on a fallback dns server (per server, unless set with 'ip:port@timeout')
+	FallBackMaxFails       = 3                // Consecutive failures before a fallback dns server is considered down
+	FallBackHealthInterval = 10 * time.Second // How often fallback dns servers are probed (0 disables)
+	FallBackCacheSize      = 10000            // Number of fallback responses to cache (0 disables)
+	FallBackCacheMaxTTL    = time.Hour        // Longest a fallback response is cached, regardless of its ttl
+
+	ImplicitWildcard = false // Answer for unknown subdomains with their parent domain's records (legacy)
+
+	SoaNs         = ""    // Primary nameserver for the zone's SOA and NS records (default 'ns1.<domain>')
+	SoaHostmaster = ""    // Responsible mailbox for the zone's SOA record (default 'hostmaster.<domain>')
+	SoaRefresh    = 3600  // Seconds secondaries wait before refreshing the zone
+	SoaRetry      = 600   // Seconds secondaries wait before retrying a failed refresh
+	SoaExpire     = 86400 // Seconds secondaries keep serving the zone without a refresh
+	SoaMinimum    = 60    // Seconds resolvers may cache negative answers
+
+	TransferAllow = "" // Clients allowed to transfer the zone (acl), none if empty
+	Notify        = "" // Secondaries sent a NOTIFY when the records change (ip[:port], comma separated)
+	NotifyRetries = 5  // Times an unacknowledged NOTIFY is resent, backing off exponentially
+	TsigKeys      = "" // TSIG keys requests may be signed with ([algorithm:]name:secret, comma separated)
+	UpdateKeys    = "" // Names of the TSIG keys that may send dynamic updates (comma separated), any if empty
+	TransferKeys  = "" // Names of the TSIG keys that may transfer the zone from anywhere (comma separated)
+
+	Dnssec       = false  // Sign answers within the zone (DNSSEC) for clients that ask for it
+	DnssecKeyDir = ""     // Directory the KSK and ZSK are loaded from (or generated into), generated every start if empty
+	DnssecDenial = "nsec" // Authenticated denial of existence [nsec|nsec3]
+
+	Regions = "" // Client networks records may be tagged with by name (name=cidr, comma separated)
+
+	AllowQuery   = "" // Clients that may query (acl: ip, cidr or any, '!' denies, first match wins, comma separated), everyone if empty
+	AllowForward = "" // Clients whose queries may be relayed to the fallback dns servers (acl), everyone if empty
+
+	Views = "" // Views clients are answered from, the first matching (name=cidr, name=key:keyname or name=any, comma separated)
+
+	HealthExec = false // Allow records' health checks to run commands (exec checks)
+
+	RateLimit           = 0  // Queries a second answered over udp for each client network (0 disables)
+	RateLimitIpv4Prefix = 24 // Prefix length ipv4 clients are grouped into networks by, for rate limiting
+	RateLimitIpv6Prefix = 56 // Prefix length ipv6 clients are grouped into networks by, for rate limiting
+	RrlResponses        = 0  // Identical responses a second sent over udp to each client network (0 disables)
+	RrlSlip             = 2  // Every nth response over the rrl limit is sent truncated instead of dropped (0 never)
+
+	QueryLog         = ""  // Where queries are logged (stdout://, file:///path, dnstap:///socket or dnstap-file:///path, comma separated), disabled if empty
+	QueryLogMaxSize  = 100 // Megabytes a query log file grows to before it's rotated
+	QueryLogMaxFiles = 5   // Rotated query log files kept
+
+	MetricsListen = "" // Listen address for prometheus metrics without the api's token (ip:port), only on the api if empty
+
 	LogLevel   = "INFO" // Log level to output [fatal|error|info|debug|trace]
 	Server     = false  // Run in server mode
 	ConfigFile = ""     // Configuration file to load
@@ -49,7 +105,47 @@ func AddFlags(cmd *cobra.Command) {
 	cmd.Flags().IntVarP(&TTL, "ttl", "T", TTL, "Default TTL for DNS records")
 	cmd.Flags().StringVarP(&Domain, "domain", "d", Domain, "Parent domain for requests")
 	cmd.Flags().StringVarP(&DnsListen, "dns-listen", "O", DnsListen, "Listen address for DNS requests (ip:port)")
-	cmd.Flags().StringVarP(&DnsFallBack, "fallback-dns", "f", DnsFallBack, "Fallback dns server address (ip:port), if not specified fallback is not used")
+	cmd.Flags().StringVarP(&DnsFallBack, "fallback-dns", "f", DnsFallBack, "Fallback dns server address(es) (ip:port[@timeout],...), if not specified fallback is not used")
+	cmd.Flags().IntVar(&EdnsUdpSize, "edns-udp-size", EdnsUdpSize, "Largest udp response advertised to (and sent to) EDNS clients")
+	cmd.Flags().StringVar(&DnsTlsListen, "dns-tls-listen", DnsTlsListen, "Listen address for DNS-over-TLS requests (ip[:port], port defaults to 853), disabled if empty")
+	cmd.Flags().StringVar(&DnsTlsCrt, "dns-tls-crt", DnsTlsCrt, "Path to SSL crt for DNS-over-TLS (defaults to the api's)")
+	cmd.Flags().StringVar(&DnsTlsKey, "dns-tls-key", DnsTlsKey, "Path to (unencrypted) SSL key for DNS-over-TLS (defaults to the api's)")
+	cmd.Flags().StringVar(&FallBackPolicy, "fallback-policy", FallBackPolicy, "Order fallback dns servers are tried in [sequential|round-robin|fastest]")
+	cmd.Flags().DurationVar(&FallBackTimeout, "fallback-timeout", FallBackTimeout, "Time to wait on a fallback dns server (per server, unless set with 'ip:port@timeout')")
+	cmd.Flags().IntVar(&FallBackMaxFails, "fallback-max-fails", FallBackMaxFails, "Consecutive failures before a fallback dns server is considered down")
+	cmd.Flags().DurationVar(&FallBackHealthInterval, "fallback-health-interval", FallBackHealthInterval, "How often fallback dns servers are probed (0 disables)")
+	cmd.Flags().IntVar(&FallBackCacheSize, "fallback-cache-size", FallBackCacheSize, "Number of fallback responses to cache (0 disables)")
+	cmd.Flags().DurationVar(&FallBackCacheMaxTTL, "fallback-cache-max-ttl", FallBackCacheMaxTTL, "Longest a fallback response is cached, regardless of its ttl")
+	cmd.Flags().BoolVar(&ImplicitWildcard, "implicit-wildcard", ImplicitWildcard, "Answer for unknown subdomains with their parent domain's records (legacy)")
+	cmd.Flags().StringVar(&SoaNs, "soa-ns", SoaNs, "Primary nameserver for the zone's SOA and NS records (default 'ns1.<domain>')")
+	cmd.Flags().StringVar(&SoaHostmaster, "soa-hostmaster", SoaHostmaster, "Responsible mailbox for the zone's SOA record (default 'hostmaster.<domain>')")
+	cmd.Flags().IntVar(&SoaRefresh, "soa-refresh", SoaRefresh, "Seconds secondaries wait before refreshing the zone")
+	cmd.Flags().IntVar(&SoaRetry, "soa-retry", SoaRetry, "Seconds secondaries wait before retrying a failed refresh")
+	cmd.Flags().IntVar(&SoaExpire, "soa-expire", SoaExpire, "Seconds secondaries keep serving the zone without a refresh")
+	cmd.Flags().IntVar(&SoaMinimum, "soa-minimum", SoaMinimum, "Seconds resolvers may cache negative answers")
+	cmd.Flags().StringVar(&TransferAllow, "transfer-allow", TransferAllow, "Clients allowed to transfer the zone (acl), none if empty")
+	cmd.Flags().StringVar(&Notify, "notify", Notify, "Secondaries sent a NOTIFY when the records change (ip[:port], comma separated)")
+	cmd.Flags().IntVar(&NotifyRetries, "notify-retries", NotifyRetries, "Times an unacknowledged NOTIFY is resent, backing off exponentially")
+	cmd.Flags().StringVar(&TsigKeys, "tsig-keys", TsigKeys, "TSIG keys requests may be signed with ([algorithm:]name:secret, comma separated)")
+	cmd.Flags().StringVar(&UpdateKeys, "update-keys", UpdateKeys, "Names of the TSIG keys that may send dynamic updates (comma separated), any if empty")
+	cmd.Flags().StringVar(&TransferKeys, "transfer-keys", TransferKeys, "Names of the TSIG keys that may transfer the zone from anywhere (comma separated)")
+	cmd.Flags().BoolVar(&Dnssec, "dnssec", Dnssec, "Sign answers within the zone (DNSSEC) for clients that ask for it")
+	cmd.Flags().StringVar(&DnssecKeyDir, "dnssec-key-dir", DnssecKeyDir, "Directory the KSK and ZSK are loaded from (or generated into), generated every start if empty")
+	cmd.Flags().StringVar(&DnssecDenial, "dnssec-denial", DnssecDenial, "Authenticated denial of existence [nsec|nsec3]")
+	cmd.Flags().StringVar(&Regions, "regions", Regions, "Client networks records may be tagged with by name (name=cidr, comma separated)")
+	cmd.Flags().StringVar(&AllowQuery, "allow-query", AllowQuery, "Clients that may query (acl: ip, cidr or any, '!' denies, first match wins, comma separated), everyone if empty")
+	cmd.Flags().StringVar(&AllowForward, "allow-forward", AllowForward, "Clients whose queries may be relayed to the fallback dns servers (acl), everyone if empty")
+	cmd.Flags().StringVar(&Views, "views", Views, "Views clients are answered from, the first matching (name=cidr, name=key:keyname or name=any, comma separated)")
+	cmd.Flags().BoolVar(&HealthExec, "health-exec", HealthExec, "Allow records' health checks to run commands (exec checks)")
+	cmd.Flags().IntVar(&RateLimit, "rate-limit", RateLimit, "Queries a second answered over udp for each client network (0 disables)")
+	cmd.Flags().IntVar(&RateLimitIpv4Prefix, "rate-limit-ipv4-prefix", RateLimitIpv4Prefix, "Prefix length ipv4 clients are grouped into networks by, for rate limiting")
+	cmd.Flags().IntVar(&RateLimitIpv6Prefix, "rate-limit-ipv6-prefix", RateLimitIpv6Prefix, "Prefix length ipv6 clients are grouped into networks by, for rate limiting")
+	cmd.Flags().IntVar(&RrlResponses, "rrl-responses", RrlResponses, "Identical responses a second sent over udp to each client network (0 disables)")
+	cmd.Flags().IntVar(&RrlSlip, "rrl-slip", RrlSlip, "Every nth response over the rrl limit is sent truncated instead of dropped (0 never)")
+	cmd.Flags().StringVar(&QueryLog, "query-log", QueryLog, "Where queries are logged (stdout://, file:///path, dnstap:///socket or dnstap-file:///path, comma separated), disabled if empty")
+	cmd.Flags().IntVar(&QueryLogMaxSize, "query-log-max-size", QueryLogMaxSize, "Megabytes a query log file grows to before it's rotated")
+	cmd.Flags().IntVar(&QueryLogMaxFiles, "query-log-max-files", QueryLogMaxFiles, "Rotated query log files kept")
+	cmd.Flags().StringVar(&MetricsListen, "metrics-listen", MetricsListen, "Listen address for prometheus metrics without the api's token (ip:port), only on the api if empty")
 
 	// core
 	cmd.Flags().StringVarP(&LogLevel, "log-level", "l", LogLevel, "Log level to output [fatal|error|info|debug|trace]")
@@ -80,6 +176,46 @@ func LoadConfigFile() error {
 	viper.SetDefault("log-level", LogLevel)
 	viper.SetDefault("server", Server)
 	viper.SetDefault("fallback-dns", DnsFallBack)
+	viper.SetDefault("edns-udp-size", EdnsUdpSize)
+	viper.SetDefault("dns-tls-listen", DnsTlsListen)
+	viper.SetDefault("dns-tls-crt", DnsTlsCrt)
+	viper.SetDefault("dns-tls-key", DnsTlsKey)
+	viper.SetDefault("fallback-policy", FallBackPolicy)
+	viper.SetDefault("fallback-timeout", FallBackTimeout)
+	viper.SetDefault("fallback-max-fails", FallBackMaxFails)
+	viper.SetDefault("fallback-health-interval", FallBackHealthInterval)
+	viper.SetDefault("fallback-cache-size", FallBackCacheSize)
+	viper.SetDefault("fallback-cache-max-ttl", FallBackCacheMaxTTL)
+	viper.SetDefault("implicit-wildcard", ImplicitWildcard)
+	viper.SetDefault("soa-ns", SoaNs)
+	viper.SetDefault("soa-hostmaster", SoaHostmaster)
+	viper.SetDefault("soa-refresh", SoaRefresh)
+	viper.SetDefault("soa-retry", SoaRetry)
+	viper.SetDefault("soa-expire", SoaExpire)
+	viper.SetDefault("soa-minimum", SoaMinimum)
+	viper.SetDefault("transfer-allow", TransferAllow)
+	viper.SetDefault("notify", Notify)
+	viper.SetDefault("notify-retries", NotifyRetries)
+	viper.SetDefault("tsig-keys", TsigKeys)
+	viper.SetDefault("update-keys", UpdateKeys)
+	viper.SetDefault("transfer-keys", TransferKeys)
+	viper.SetDefault("dnssec", Dnssec)
+	viper.SetDefault("dnssec-key-dir", DnssecKeyDir)
+	viper.SetDefault("dnssec-denial", DnssecDenial)
+	viper.SetDefault("regions", Regions)
+	viper.SetDefault("allow-query", AllowQuery)
+	viper.SetDefault("allow-forward", AllowForward)
+	viper.SetDefault("views", Views)
+	viper.SetDefault("health-exec", HealthExec)
+	viper.SetDefault("rate-limit", RateLimit)
+	viper.SetDefault("rate-limit-ipv4-prefix", RateLimitIpv4Prefix)
+	viper.SetDefault("rate-limit-ipv6-prefix", RateLimitIpv6Prefix)
+	viper.SetDefault("rrl-responses", RrlResponses)
+	viper.SetDefault("rrl-slip", RrlSlip)
+	viper.SetDefault("query-log", QueryLog)
+	viper.SetDefault("query-log-max-size", QueryLogMaxSize)
+	viper.SetDefault("query-log-max-files", QueryLogMaxFiles)
+	viper.SetDefault("metrics-listen", MetricsListen)
 
 	filename := filepath.Base(ConfigFile)
 	viper.SetConfigName(filename[:len(filename)-len(filepath.Ext(filename))])
@@ -102,6 +238,47 @@ func LoadConfigFile() error {
 	TTL = viper.GetInt("ttl")
 	Domain = viper.GetString("domain")
 	DnsListen = viper.GetString("dns-listen")
+	DnsFallBack = strings.Join(viper.GetStringSlice("fallback-dns"), ",") // list or comma separated string
+	EdnsUdpSize = viper.GetInt("edns-udp-size")
+	DnsTlsListen = viper.GetString("dns-tls-listen")
+	DnsTlsCrt = viper.GetString("dns-tls-crt")
+	DnsTlsKey = viper.GetString("dns-tls-key")
+	FallBackPolicy = viper.GetString("fallback-policy")
+	FallBackTimeout = viper.GetDuration("fallback-timeout")
+	FallBackMaxFails = viper.GetInt("fallback-max-fails")
+	FallBackHealthInterval = viper.GetDuration("fallback-health-interval")
+	FallBackCacheSize = viper.GetInt("fallback-cache-size")
+	FallBackCacheMaxTTL = viper.GetDuration("fallback-cache-max-ttl")
+	ImplicitWildcard = viper.GetBool("implicit-wildcard")
+	SoaNs = viper.GetString("soa-ns")
+	SoaHostmaster = viper.GetString("soa-hostmaster")
+	SoaRefresh = viper.GetInt("soa-refresh")
+	SoaRetry = viper.GetInt("soa-retry")
+	SoaExpire = viper.GetInt("soa-expire")
+	SoaMinimum = viper.GetInt("soa-minimum")
+	TransferAllow = strings.Join(viper.GetStringSlice("transfer-allow"), ",") // list or comma separated string
+	Notify = strings.Join(viper.GetStringSlice("notify"), ",")                // list or comma separated string
+	NotifyRetries = viper.GetInt("notify-retries")
+	TsigKeys = strings.Join(viper.GetStringSlice("tsig-keys"), ",")         // list or comma separated string
+	UpdateKeys = strings.Join(viper.GetStringSlice("update-keys"), ",")     // list or comma separated string
+	TransferKeys = strings.Join(viper.GetStringSlice("transfer-keys"), ",") // list or comma separated string
+	Dnssec = viper.GetBool("dnssec")
+	DnssecKeyDir = viper.GetString("dnssec-key-dir")
+	DnssecDenial = viper.GetString("dnssec-denial")
+	Regions = strings.Join(viper.GetStringSlice("regions"), ",")            // list or comma separated string
+	AllowQuery = strings.Join(viper.GetStringSlice("allow-query"), ",")     // list or comma separated string
+	AllowForward = strings.Join(viper.GetStringSlice("allow-forward"), ",") // list or comma separated string
+	Views = strings.Join(viper.GetStringSlice("views"), ",")                // list or comma separated string
+	HealthExec = viper.GetBool("health-exec")
+	RateLimit = viper.GetInt("rate-limit")
+	RateLimitIpv4Prefix = viper.GetInt("rate-limit-ipv4-prefix")
+	RateLimitIpv6Prefix = viper.GetInt("rate-limit-ipv6-prefix")
+	RrlResponses = viper.GetInt("rrl-responses")
+	RrlSlip = viper.GetInt("rrl-slip")
+	QueryLog = strings.Join(viper.GetStringSlice("query-log"), ",") // list or comma separated string
+	QueryLogMaxSize = viper.GetInt("query-log-max-size")
+	QueryLogMaxFiles = viper.GetInt("query-log-max-files")
+	MetricsListen = viper.GetString("metrics-listen")
 	LogLevel = viper.GetString("log-level")
 	Server = viper.GetBool("server")
 
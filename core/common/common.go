@@ -3,6 +3,7 @@ package common
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/nanopack/shaman/config"
 )
@@ -11,6 +12,11 @@ import (
 type Resource struct {
 	Domain  string   `json:"domain"`  // google.com
 	Records []Record `json:"records"` // dns records
+
+	Policy  string `json:"policy,omitempty"`  // how records are answered [all|shuffle|weighted|top] (all)
+	Answers int    `json:"answers,omitempty"` // records of each type answered with the top policy
+
+	Views []string `json:"views,omitempty"` // views the domain exists in, every view if empty
 }
 
 // Record contains dns information
@@ -19,6 +25,22 @@ type Record struct {
 	Class   string `json:"class"`   // protocol family (IN)
 	RType   string `json:"type"`    // dns record type (A)
 	Address string `json:"address"` // address domain resolves to (216.58.217.46)
+
+	Subnets []string `json:"subnets,omitempty"` // clients the record is for (cidrs or regions), everyone if empty
+	Weight  int      `json:"weight,omitempty"`  // relative chance of being answered with, by the answer policy (1)
+	Check   *Check   `json:"check,omitempty"`   // health check, the record is left out of answers while it fails
+	Views   []string `json:"views,omitempty"`   // views the record is answered in, every view if empty
+}
+
+// Check describes how the backend behind a record is health checked
+type Check struct {
+	Type     string `json:"type"`               // tcp (connect), http (get) or exec (run)
+	Target   string `json:"target"`             // address to connect to (ip:port), url to get or command to run
+	Status   int    `json:"status,omitempty"`   // http status expected (200)
+	Interval int    `json:"interval,omitempty"` // seconds between checks (10)
+	Timeout  int    `json:"timeout,omitempty"`  // seconds a check may take (2)
+	Rise     int    `json:"rise,omitempty"`     // passes in a row before a failed record is answered with again (2)
+	Fall     int    `json:"fall,omitempty"`     // failures in a row before a record is left out (3)
 }
 
 // StringSlice returns a slice of strings with dns info, each ready for dns.NewRR
@@ -48,10 +70,27 @@ func UnsanitizeDomain(domain *string) {
 	}
 }
 
-// Validate ensures record values are set
-func (self *Resource) Validate() {
+// policies are the answer policies a resource may have
+var policies = []string{"all", "shuffle", "weighted", "top"}
+
+// Validate ensures record values are set, returning an error for any that
+// can't be answered with
+func (self *Resource) Validate() error {
 	SanitizeDomain(&self.Domain)
 
+	if self.Policy != "" {
+		known := false
+		for i := range policies {
+			known = known || strings.ToLower(self.Policy) == policies[i]
+		}
+		if !known {
+			return fmt.Errorf("Unknown answer policy '%s' - expected one of %s", self.Policy, strings.Join(policies, ", "))
+		}
+	}
+	if self.Answers < 0 {
+		return fmt.Errorf("Bad answers '%d' - can't be negative", self.Answers)
+	}
+
 	for i := range self.Records {
 		if self.Records[i].Class == "" {
 			self.Records[i].Class = "IN"
@@ -62,5 +101,25 @@ func (self *Resource) Validate() {
 		if self.Records[i].RType == "" {
 			self.Records[i].RType = "A"
 		}
+		if check := self.Records[i].Check; check != nil {
+			check.Type = strings.ToLower(check.Type)
+			if check.Status == 0 && check.Type == "http" {
+				check.Status = 200
+			}
+			if check.Interval <= 0 {
+				check.Interval = 10
+			}
+			if check.Timeout <= 0 {
+				check.Timeout = 2
+			}
+			if check.Rise <= 0 {
+				check.Rise = 2
+			}
+			if check.Fall <= 0 {
+				check.Fall = 3
+			}
+		}
 	}
+
+	return nil
 }
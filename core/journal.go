@@ -0,0 +1,94 @@
+package shaman
+
+import (
+	"sync"
+	"time"
+
+	sham "github.com/nanopack/shaman/core/common"
+)
+
+// journalSize is how many changes are remembered for incremental transfers
+const journalSize = 100
+
+// Change is a single committed change to the known records, as needed to
+// serve incremental zone transfers (IXFR).
+type Change struct {
+	Serial  uint32          // serial after the change
+	Removed []sham.Resource // resources as they were before the change
+	Added   []sham.Resource // resources as they are after the change
+}
+
+var (
+	// changes remembers the serial and most recent changes
+	changes = &journal{serial: uint32(time.Now().Unix())}
+
+	// listeners are told of the new serial after every change
+	listeners     []func(serial uint32)
+	listenersLock sync.RWMutex
+)
+
+type journal struct {
+	sync.RWMutex
+	serial  uint32
+	entries []Change
+}
+
+// record bumps the serial and remembers what changed, returning the new serial
+// (for the listeners to be told of, once mutex is released)
+func (self *journal) record(removed, added []sham.Resource) uint32 {
+	self.Lock()
+	defer self.Unlock()
+	self.serial++
+	self.entries = append(self.entries, Change{Serial: self.serial, Removed: removed, Added: added})
+	if len(self.entries) > journalSize {
+		self.entries = self.entries[len(self.entries)-journalSize:]
+	}
+	return self.serial
+}
+
+// changed tells the listeners of the new serial, if there is one. It is
+// deferred before mutex is taken, so listeners may call back into shaman.
+func changed(serial *uint32) {
+	if *serial == 0 {
+		return
+	}
+	listenersLock.RLock()
+	defer listenersLock.RUnlock()
+	for i := range listeners {
+		listeners[i](*serial)
+	}
+}
+
+// OnChange registers fn to be called with the new serial whenever the records
+// change. It is called by whatever made the change, so it shouldn't block.
+func OnChange(fn func(serial uint32)) {
+	listenersLock.Lock()
+	listeners = append(listeners, fn)
+	listenersLock.Unlock()
+}
+
+// Serial returns the current serial, which increments with every change
+func Serial() uint32 {
+	changes.RLock()
+	defer changes.RUnlock()
+	return changes.serial
+}
+
+// Changes returns the changes made since serial, oldest first. If they are no
+// longer all remembered, false is returned and a full transfer is needed.
+func Changes(serial uint32) ([]Change, bool) {
+	changes.RLock()
+	defer changes.RUnlock()
+
+	if serial == changes.serial {
+		return []Change{}, true
+	}
+	for i := range changes.entries {
+		if changes.entries[i].Serial == serial+1 {
+			since := make([]Change, len(changes.entries)-i)
+			copy(since, changes.entries[i:])
+			return since, true
+		}
+	}
+	return nil, false
+}
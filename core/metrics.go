@@ -0,0 +1,22 @@
+package shaman
+
+import (
+	"github.com/nanopack/shaman/metrics"
+)
+
+// gauges of the known records, read from memory when the metrics are
+var (
+	_ = metrics.NewGaugeFunc("shaman_domains", "Domains with records", func() float64 {
+		return float64(answers.len())
+	})
+	_ = metrics.NewGaugeFunc("shaman_records", "Records, across every domain", func() float64 {
+		count := 0
+		for _, resource := range answers.list() {
+			count += len(resource.Records)
+		}
+		return float64(count)
+	})
+	_ = metrics.NewGaugeFunc("shaman_serial", "Serial of the records (the zone's SOA serial)", func() float64 {
+		return float64(Serial())
+	})
+)
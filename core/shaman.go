@@ -1,41 +1,59 @@
 // Package shaman contains the logic to add/remove DNS entries.
 package shaman
 
-// todo: atomic C.U.D.
-
 import (
 	"fmt"
+	"sync"
 
 	"github.com/nanopack/shaman/cache"
 	"github.com/nanopack/shaman/config"
 	sham "github.com/nanopack/shaman/core/common"
 )
 
-// Answers is the cached collection of dns records
-var Answers map[string]sham.Resource
+var (
+	// answers is the cached collection of dns records
+	answers = newStore()
 
-func init() {
-	Answers = make(map[string]sham.Resource, 0)
-}
+	// mutex serializes changes so the persistent cache and answers agree
+	mutex = sync.Mutex{}
+)
 
 // GetRecord returns a resource for the specified domain
 func GetRecord(domain string) (sham.Resource, error) {
 	sham.SanitizeDomain(&domain)
 
-	resource, ok := Answers[domain]
-	// if domain not cached in memory...
-	if !ok {
-		// fetch from cache
-		record, err := cache.GetRecord(domain)
-		if record == nil {
-			return resource, fmt.Errorf("Failed to find domain - %v", err)
-		}
-		// update local cache
+	resource, ok := answers.get(domain)
+	if ok {
+		return resource, nil
+	}
+
+	if !cache.Exists() {
+		return resource, fmt.Errorf("Failed to find domain - '%s'", domain)
+	}
+
+	// if domain not cached in memory, fetch from cache (without holding mutex,
+	// it may be a round trip away)
+	generation := answers.generation()
+	record, err := cache.GetRecord(domain)
+	if record == nil {
+		return resource, fmt.Errorf("Failed to find domain - %v", err)
+	}
+	resource = *record
+
+	// update local cache, unless the domain was changed meanwhile, or may have
+	// been deleted (so isn't brought back)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if current, ok := answers.get(domain); ok {
+		return current, nil
+	}
+	if answers.generation() == generation {
 		config.Log.Debug("Cache differs from local, updating...")
-		Answers[domain] = *record
+		answers.set(resource)
 	}
 
-	return Answers[domain], nil
+	return resource, nil
 }
 
 // ListDomains returns a list of all known domains
@@ -55,24 +73,59 @@ func ListRecords() []sham.Resource {
 	if cache.Exists() {
 		// get from cache
 		stored, _ := cache.ListRecords()
-		if len(Answers) != len(stored) {
+		if answers.len() != len(stored) {
 			config.Log.Debug("Cache differs from local, updating...")
-			ResetRecords(&stored, true)
+			syncRecords()
 		}
 	}
 
-	resources := make([]sham.Resource, 0)
-	for _, v := range Answers {
-		resources = append(resources, v)
+	return answers.list()
+}
+
+// syncRecords replaces the answers with what's in the persistent cache. The
+// answers only catch up with the cache, so it isn't recorded as a change (which
+// would bump the serial and notify secondaries).
+func syncRecords() {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	// read again, holding mutex, so changes made meanwhile aren't undone
+	stored, err := cache.ListRecords()
+	if err != nil {
+		config.Log.Error("Failed to sync records from cache - %v", err)
+		return
 	}
 
-	return resources
+	resourceMap := make(map[string]sham.Resource)
+	for i := range stored {
+		stored[i].Validate()
+		resourceMap[stored[i].Domain] = stored[i]
+	}
+	answers.reset(resourceMap)
 }
 
 // DeleteRecord deletes the resource(domain)
 func DeleteRecord(domain string) error {
 	sham.SanitizeDomain(&domain)
 
+	var serial uint32
+	defer changed(&serial)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	old, ok := answers.get(domain)
+	err := deleteRecord(domain)
+	if err == nil && ok {
+		serial = changes.record([]sham.Resource{old}, nil)
+	}
+	return err
+}
+
+// deleteRecord deletes the resource(domain), callers must hold mutex
+func deleteRecord(domain string) error {
+	sham.SanitizeDomain(&domain)
+
 	// update cache
 	config.Log.Trace("Removing record from persistent cache...")
 	err := cache.DeleteRecord(domain)
@@ -80,8 +133,7 @@ func DeleteRecord(domain string) error {
 		return err
 	}
 
-	// todo: atomic
-	delete(Answers, domain)
+	answers.delete(domain)
 
 	// otherwise, be idempotent and report it was deleted...
 	return nil
@@ -89,20 +141,36 @@ func DeleteRecord(domain string) error {
 
 // AddRecord adds a record to a resource(domain)
 func AddRecord(resource *sham.Resource) error {
-	resource.Validate()
+	if err := resource.Validate(); err != nil {
+		return err
+	}
 	domain := resource.Domain
 
-	// todo: atomic
-	_, ok := Answers[domain]
+	var serial uint32
+	defer changed(&serial)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	removed := make([]sham.Resource, 0)
+	existing, ok := answers.get(domain)
 	if ok {
+		removed = append(removed, existing)
 		config.Log.Trace("Domain is in local cache")
+		// keep the answer policy and views, unless new ones are given
+		if resource.Policy == "" {
+			resource.Policy, resource.Answers = existing.Policy, existing.Answers
+		}
+		if len(resource.Views) == 0 {
+			resource.Views = existing.Views
+		}
 		// if we have the domain registered...
-		for k := range Answers[domain].Records {
+		for k := range existing.Records {
 			for j := range resource.Records {
 				// check if the record exists...
-				if resource.Records[j].RType == Answers[domain].Records[k].RType &&
-					resource.Records[j].Address == Answers[domain].Records[k].Address &&
-					resource.Records[j].Class == Answers[domain].Records[k].Class {
+				if resource.Records[j].RType == existing.Records[k].RType &&
+					resource.Records[j].Address == existing.Records[k].Address &&
+					resource.Records[j].Class == existing.Records[k].Class {
 					// if so, skip...
 					config.Log.Trace("Record exists in local cache, skipping...")
 					goto next
@@ -110,7 +178,7 @@ func AddRecord(resource *sham.Resource) error {
 			}
 			// otherwise, add the record
 			config.Log.Trace("Record not in local cache, adding...")
-			resource.Records = append(resource.Records, Answers[domain].Records[k])
+			resource.Records = append(resource.Records, existing.Records[k])
 		next:
 		}
 	}
@@ -123,7 +191,8 @@ func AddRecord(resource *sham.Resource) error {
 	}
 
 	// add the resource to the list of knowns
-	Answers[domain] = *resource
+	answers.set(*resource)
+	serial = changes.record(removed, []sham.Resource{*resource})
 
 	return nil
 }
@@ -131,19 +200,42 @@ func AddRecord(resource *sham.Resource) error {
 // Exists returns whether or not that domain exists
 func Exists(domain string) bool {
 	sham.SanitizeDomain(&domain)
-	_, ok := Answers[domain]
+	_, ok := answers.get(domain)
 	return ok
 }
 
+// HasSubdomain returns whether any known domain falls beneath domain
+func HasSubdomain(domain string) bool {
+	sham.SanitizeDomain(&domain)
+	return answers.hasSubdomain(domain)
+}
+
 // UpdateRecord updates a record to a resource(domain)
 func UpdateRecord(domain string, resource *sham.Resource) error {
-	resource.Validate()
+	if err := resource.Validate(); err != nil {
+		return err
+	}
 	sham.SanitizeDomain(&domain)
 
+	var serial uint32
+	defer changed(&serial)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	// remember what is replaced, for incremental transfers
+	removed := make([]sham.Resource, 0)
+	if old, ok := answers.get(domain); ok {
+		removed = append(removed, old)
+	}
+	if old, ok := answers.get(resource.Domain); ok && domain != resource.Domain {
+		removed = append(removed, old)
+	}
+
 	// in case of some update to domain name...
 	if domain != resource.Domain {
 		// delete old domain
-		err := DeleteRecord(domain)
+		err := deleteRecord(domain)
 		if err != nil {
 			return fmt.Errorf("Failed to clean up old domain - %v", err)
 		}
@@ -157,8 +249,8 @@ func UpdateRecord(domain string, resource *sham.Resource) error {
 	}
 
 	// set new resource to domain
-	// todo: atomic
-	Answers[resource.Domain] = *resource
+	answers.set(*resource)
+	serial = changes.record(removed, []sham.Resource{*resource})
 
 	return nil
 }
@@ -166,16 +258,24 @@ func UpdateRecord(domain string, resource *sham.Resource) error {
 // ResetRecords resets all answers. If any nocache has any values, caching is skipped
 func ResetRecords(resources *[]sham.Resource, nocache ...bool) error {
 	for i := range *resources {
-		(*resources)[i].Validate()
+		if err := (*resources)[i].Validate(); err != nil {
+			return err
+		}
 	}
 
 	// new map to clear current answers
-	answers := make(map[string]sham.Resource)
+	resourceMap := make(map[string]sham.Resource)
 
 	for i := range *resources {
-		answers[(*resources)[i].Domain] = (*resources)[i]
+		resourceMap[(*resources)[i].Domain] = (*resources)[i]
 	}
 
+	var serial uint32
+	defer changed(&serial)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
 	if len(nocache) == 0 {
 		// store in cache
 		config.Log.Trace("Resetting records in persistent cache...")
@@ -186,8 +286,86 @@ func ResetRecords(resources *[]sham.Resource, nocache ...bool) error {
 	}
 
 	// reset the answers
-	// todo: atomic
-	Answers = answers
+	removed := answers.list()
+	answers.reset(resourceMap)
+	serial = changes.record(removed, append([]sham.Resource{}, *resources...))
+
+	return nil
+}
+
+// ChangeRecords saves resources and deletes the deleted domains as a single
+// change: either all of them are made, or (should the persistent cache fail
+// partway) none are
+func ChangeRecords(resources []sham.Resource, deleted []string) error {
+	for i := range resources {
+		if err := resources[i].Validate(); err != nil {
+			return err
+		}
+	}
+	for i := range deleted {
+		sham.SanitizeDomain(&deleted[i])
+	}
+
+	var serial uint32
+	defer changed(&serial)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	// what undoes each change made to the persistent cache, should a later one
+	// fail (the answers are only changed once all have been)
+	undo := make([]func() error, 0)
+	rollback := func() {
+		for i := len(undo) - 1; i >= 0; i-- {
+			if err := undo[i](); err != nil {
+				config.Log.Error("Failed to roll back persistent cache - %v", err)
+			}
+		}
+	}
+
+	removed := make([]sham.Resource, 0)
+	for _, domain := range deleted {
+		old, ok := answers.get(domain)
+		if !ok {
+			continue
+		}
+		if err := cache.DeleteRecord(domain); err != nil {
+			rollback()
+			return err
+		}
+		undo = append(undo, func() error { return cache.AddRecord(&old) })
+		removed = append(removed, old)
+	}
+	for i := range resources {
+		domain := resources[i].Domain
+		old, ok := answers.get(domain)
+		var err error
+		if ok {
+			err = cache.UpdateRecord(domain, &resources[i])
+		} else {
+			err = cache.AddRecord(&resources[i])
+		}
+		if err != nil {
+			rollback()
+			return err
+		}
+		if ok {
+			undo = append(undo, func() error { return cache.UpdateRecord(domain, &old) })
+			removed = append(removed, old)
+		} else {
+			undo = append(undo, func() error { return cache.DeleteRecord(domain) })
+		}
+	}
+
+	for _, domain := range deleted {
+		answers.delete(domain)
+	}
+	for i := range resources {
+		answers.set(resources[i])
+	}
+	if len(removed) > 0 || len(resources) > 0 {
+		serial = changes.record(removed, append([]sham.Resource{}, resources...))
+	}
 
 	return nil
 }
@@ -3,7 +3,9 @@ package shaman_test
 import (
 	"fmt"
 	"os"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/jcelliott/lumber"
 
@@ -79,6 +81,25 @@ func TestResetRecords(t *testing.T) {
 	}
 }
 
+func TestChangeRecords(t *testing.T) {
+	shamanClear()
+	shaman.AddRecord(&nanopack)
+	serial := shaman.Serial()
+	err := shaman.ChangeRecords([]sham.Resource{nanobox}, []string{"nanopack.io"})
+	if err != nil {
+		t.Errorf("Failed to change records - %v", err)
+	}
+	if shaman.Exists("nanopack.io") || !shaman.Exists("nanobox.io") || shaman.Serial() != serial+1 {
+		t.Errorf("Expected records changed at once, serial %d to %d", serial, shaman.Serial())
+	}
+
+	// nothing is changed if any change is bad
+	err = shaman.ChangeRecords([]sham.Resource{nanopack, {Domain: "bad.nanopack.io", Policy: "bogus"}}, nil)
+	if err == nil || shaman.Exists("nanopack.io") {
+		t.Errorf("Expected no change with a bad resource - %v", err)
+	}
+}
+
 func TestListDomains(t *testing.T) {
 	shamanClear()
 	domains := shaman.ListDomains()
@@ -96,12 +117,12 @@ func TestListRecords(t *testing.T) {
 	shamanClear()
 	resources := shaman.ListRecords()
 	if fmt.Sprint(resources) != "[]" {
-		t.Errorf("Failed to list records - %+q", resources)
+		t.Errorf("Failed to list records - %+v", resources)
 	}
 	shaman.ResetRecords(&nanoBoth)
 	resources = shaman.ListRecords()
 	if len(resources) == 2 && (resources[0].Domain != "nanopack.io." && resources[0].Domain != "nanobox.io.") {
-		t.Errorf("Failed to list records - %+q", resources)
+		t.Errorf("Failed to list records - %+v", resources)
 	}
 }
 
@@ -116,6 +137,112 @@ func TestExists(t *testing.T) {
 	}
 }
 
+func TestSerial(t *testing.T) {
+	shamanClear()
+	serial := shaman.Serial()
+	shaman.AddRecord(&nanopack)
+	shaman.DeleteRecord("nanobox.io") // nothing to delete
+	shaman.DeleteRecord("nanopack.io")
+	if shaman.Serial() != serial+2 {
+		t.Errorf("Expected serial %d, got %d", serial+2, shaman.Serial())
+	}
+
+	changes, ok := shaman.Changes(serial)
+	if !ok || len(changes) != 2 {
+		t.Errorf("Expected 2 changes - %v", changes)
+		t.FailNow()
+	}
+	if len(changes[0].Added) != 1 || len(changes[1].Removed) != 1 || changes[1].Serial != serial+2 {
+		t.Errorf("Bad changes - %v", changes)
+	}
+
+	// too old to know what changed
+	if _, ok := shaman.Changes(serial - 1000); ok {
+		t.Error("Expected unknown changes")
+	}
+}
+
+func TestOnChange(t *testing.T) {
+	shamanClear()
+	serials := make(chan uint32, 1)
+	// listeners may call back into shaman
+	shaman.OnChange(func(serial uint32) {
+		shaman.GetRecord("missing.nanopack.io") // takes the lock changes are made under
+		select {
+		case serials <- serial:
+		default:
+		}
+	})
+
+	done := make(chan struct{})
+	go func() {
+		shaman.AddRecord(&nanopack)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("Listener deadlocked")
+		t.FailNow()
+	}
+	if serial := <-serials; serial != shaman.Serial() {
+		t.Errorf("Expected serial %d, got %d", shaman.Serial(), serial)
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	shamanClear()
+	shaman.AddRecord(&nanopack)
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+
+	// readers
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				shaman.GetRecord("nanopack.io")
+				shaman.Exists("nanobox.io")
+				shaman.ListRecords()
+			}
+		}()
+	}
+
+	// writers
+	for i := 0; i < 200; i++ {
+		domain := fmt.Sprintf("%d.nanobox.io.", i)
+		resource := sham.Resource{Domain: domain, Records: []sham.Record{{Address: "127.0.0.2"}}}
+		if err := shaman.AddRecord(&resource); err != nil {
+			t.Errorf("Failed to add record - %v", err)
+		}
+		if err := shaman.UpdateRecord(domain, &nanobox); err != nil {
+			t.Errorf("Failed to update record - %v", err)
+		}
+		if err := shaman.DeleteRecord("nanobox.io"); err != nil {
+			t.Errorf("Failed to delete record - %v", err)
+		}
+		if i%50 == 0 {
+			if err := shaman.ResetRecords(&nanoBoth); err != nil {
+				t.Errorf("Failed to reset records - %v", err)
+			}
+		}
+	}
+
+	close(done)
+	wg.Wait()
+
+	if !shaman.Exists("nanopack.io") {
+		t.Errorf("Lost record during concurrent access")
+	}
+}
+
 func shamanClear() {
-	shaman.Answers = make(map[string]sham.Resource, 0)
+	shaman.ResetRecords(&[]sham.Resource{}, true)
 }
@@ -0,0 +1,95 @@
+package shaman
+
+import (
+	"strings"
+	"sync"
+
+	sham "github.com/nanopack/shaman/core/common"
+)
+
+// store is a concurrency-safe, in-memory collection of resources keyed by
+// (sanitized) domain. Readers (dns lookups) never block each other.
+type store struct {
+	sync.RWMutex
+	resources map[string]sham.Resource
+	removals  uint64 // counts deletes and resets, which may remove domains
+}
+
+func newStore() *store {
+	return &store{resources: make(map[string]sham.Resource, 0)}
+}
+
+// get returns the resource for domain and whether it was found
+func (self *store) get(domain string) (sham.Resource, bool) {
+	self.RLock()
+	resource, ok := self.resources[domain]
+	self.RUnlock()
+	return resource, ok
+}
+
+// set stores the resource under its domain
+func (self *store) set(resource sham.Resource) {
+	self.Lock()
+	self.resources[resource.Domain] = resource
+	self.Unlock()
+}
+
+// delete removes domain from the store
+func (self *store) delete(domain string) {
+	self.Lock()
+	delete(self.resources, domain)
+	self.removals++
+	self.Unlock()
+}
+
+// generation returns how many times domains may have been removed, to tell
+// whether a resource read elsewhere may since have been
+func (self *store) generation() uint64 {
+	self.RLock()
+	defer self.RUnlock()
+	return self.removals
+}
+
+// len returns the number of stored domains
+func (self *store) len() int {
+	self.RLock()
+	defer self.RUnlock()
+	return len(self.resources)
+}
+
+// hasSubdomain returns whether any stored domain falls beneath domain
+func (self *store) hasSubdomain(domain string) bool {
+	suffix := "." + strings.ToLower(domain)
+	if domain == "." {
+		suffix = "."
+	}
+
+	self.RLock()
+	defer self.RUnlock()
+	for k := range self.resources {
+		if k != domain && strings.HasSuffix(strings.ToLower(k), suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// list returns a snapshot of all stored resources
+func (self *store) list() []sham.Resource {
+	self.RLock()
+	defer self.RUnlock()
+
+	resources := make([]sham.Resource, 0, len(self.resources))
+	for _, v := range self.resources {
+		resources = append(resources, v)
+	}
+	return resources
+}
+
+// reset replaces everything in the store with resources
+func (self *store) reset(resources map[string]sham.Resource) {
+	self.Lock()
+	self.resources = resources
+	self.removals++
+	self.Unlock()
+}
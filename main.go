@@ -47,6 +47,7 @@ import (
 	"github.com/nanopack/shaman/cache"
 	"github.com/nanopack/shaman/commands"
 	"github.com/nanopack/shaman/config"
+	"github.com/nanopack/shaman/metrics"
 	"github.com/nanopack/shaman/server"
 )
 
@@ -125,6 +126,11 @@ func startShaman(ccmd *cobra.Command, args []string) error {
 	go func() {
 		errors <- server.Start()
 	}()
+	if config.MetricsListen != "" {
+		go func() {
+			errors <- metrics.Start()
+		}()
+	}
 
 	// break if any of them return an error (blocks exit)
 	if err := <-errors; err != nil {
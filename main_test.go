@@ -2,10 +2,10 @@ package main
 
 import (
 	"bytes"
+	"net"
 	"os"
 	"strings"
 	"testing"
-	"time"
 
 	"github.com/nanopack/shaman/config"
 )
@@ -16,15 +16,7 @@ func TestMain(m *testing.M) {
 	discard := &bytes.Buffer{}
 	shamanTool.SetOutput(discard)
 
-	// set args for shaman
-	args := strings.Split("-O 127.0.0.1:8053 -2 none:// -s", " ")
-	shamanTool.SetArgs(args)
-
-	// run shaman server
-	go main()
-	<-time.After(time.Second)
-
-	// run tests
+	// run tests (one at a time, as the tool isn't safe to run concurrently)
 	rtn := m.Run()
 
 	os.Exit(rtn)
@@ -63,15 +55,18 @@ func TestBadCache(t *testing.T) {
 }
 
 func TestBadDNSListen(t *testing.T) {
+	// hold the port the dns listener wants
+	conn, err := net.ListenPacket("udp", "127.0.0.1:8053")
+	if err != nil {
+		t.Fatalf("Failed to listen - %v", err)
+	}
+	defer conn.Close()
+
 	config.L2Connect = "none://"
-	config.DnsListen = "127.0.0.1:53"
+	config.DnsListen = "127.0.0.1:8053"
 	args := strings.Split("-s", " ")
 	shamanTool.SetArgs(args)
 
-	go shamanTool.Execute()
-	<-time.After(time.Second)
-
 	// port already in use, will fail here
 	shamanTool.Execute()
-	config.DnsListen = "127.0.0.1:8053"
 }
@@ -0,0 +1,238 @@
+// Package metrics keeps shaman's metrics, and serves them in the prometheus
+// text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nanopack/shaman/config"
+)
+
+// DefaultBuckets are the histogram buckets for latencies, in seconds
+var DefaultBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// registry holds every metric, in the order they were made
+var registry struct {
+	sync.Mutex
+	metrics []metric
+}
+
+// metric is something that can write itself out
+type metric interface {
+	write(w io.Writer)
+}
+
+// CounterVec is a counter for each set of label values
+type CounterVec struct {
+	sync.Mutex
+	name   string
+	help   string
+	labels []string
+	values map[string]*counter
+}
+
+type counter struct {
+	labels []string
+	value  float64
+}
+
+// HistogramVec is a histogram for each set of label values
+type HistogramVec struct {
+	sync.Mutex
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	values  map[string]*histogram
+}
+
+type histogram struct {
+	labels []string
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// GaugeFunc is a gauge whose value is read when the metrics are
+type GaugeFunc struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+// NewCounterVec makes (and registers) a counter with the labels
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: labels, values: make(map[string]*counter)}
+	register(c)
+	return c
+}
+
+// NewHistogramVec makes (and registers) a histogram with the buckets (upper
+// bounds, ascending) and labels
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogram)}
+	register(h)
+	return h
+}
+
+// NewGaugeFunc makes (and registers) a gauge whose value is whatever value returns
+func NewGaugeFunc(name, help string, value func() float64) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, value: value}
+	register(g)
+	return g
+}
+
+func register(m metric) {
+	registry.Lock()
+	registry.metrics = append(registry.metrics, m)
+	registry.Unlock()
+}
+
+// Inc adds one to the counter with the label values
+func (self *CounterVec) Inc(labels ...string) {
+	self.Add(1, labels...)
+}
+
+// Add adds v to the counter with the label values
+func (self *CounterVec) Add(v float64, labels ...string) {
+	key := strings.Join(labels, "\xff")
+	self.Lock()
+	defer self.Unlock()
+	c, ok := self.values[key]
+	if !ok {
+		c = &counter{labels: labels}
+		self.values[key] = c
+	}
+	c.value += v
+}
+
+// Observe adds v to the histogram with the label values
+func (self *HistogramVec) Observe(v float64, labels ...string) {
+	key := strings.Join(labels, "\xff")
+	self.Lock()
+	defer self.Unlock()
+	h, ok := self.values[key]
+	if !ok {
+		h = &histogram{labels: labels, counts: make([]uint64, len(self.buckets))}
+		self.values[key] = h
+	}
+	for i := range self.buckets {
+		if v <= self.buckets[i] {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+func (self *CounterVec) write(w io.Writer) {
+	self.Lock()
+	defer self.Unlock()
+	header(w, self.name, self.help, "counter")
+	keys := make([]string, 0, len(self.values))
+	for key := range self.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		c := self.values[key]
+		fmt.Fprintf(w, "%s%s %s\n", self.name, labels(self.labels, c.labels), value(c.value))
+	}
+}
+
+func (self *HistogramVec) write(w io.Writer) {
+	self.Lock()
+	defer self.Unlock()
+	header(w, self.name, self.help, "histogram")
+	keys := make([]string, 0, len(self.values))
+	for key := range self.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	bucketLabels := append(append([]string{}, self.labels...), "le")
+	for _, key := range keys {
+		h := self.values[key]
+		le := append([]string{}, h.labels...)
+		var cumulative uint64
+		for i := range self.buckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", self.name, labels(bucketLabels, append(le, value(self.buckets[i]))), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", self.name, labels(bucketLabels, append(le, "+Inf")), h.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", self.name, labels(self.labels, h.labels), value(h.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", self.name, labels(self.labels, h.labels), h.count)
+	}
+}
+
+func (self *GaugeFunc) write(w io.Writer) {
+	header(w, self.name, self.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", self.name, value(self.value()))
+}
+
+// Write writes every metric out in the prometheus text format
+func Write(w io.Writer) {
+	registry.Lock()
+	metrics := append([]metric{}, registry.metrics...)
+	registry.Unlock()
+
+	buf := bufio.NewWriter(w)
+	for i := range metrics {
+		metrics[i].write(buf)
+	}
+	buf.Flush()
+}
+
+// Handler serves the metrics
+func Handler(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	Write(rw)
+}
+
+// Start serves the metrics (at /metrics) on their own listener, for scrapers
+// that can't pass the api's auth token
+func Start() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", Handler)
+	config.Log.Info("Metrics listening at http://%s/metrics", config.MetricsListen)
+	return fmt.Errorf("Metrics stopped - %v", http.ListenAndServe(config.MetricsListen, mux))
+}
+
+func header(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, strings.NewReplacer("\\", `\\`, "\n", `\n`).Replace(help), name, kind)
+}
+
+// labels formats label names and values as `{name="value",...}`
+func labels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	escape := strings.NewReplacer("\\", `\\`, "\"", `\"`, "\n", `\n`)
+	pairs := make([]string, len(names))
+	for i := range names {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		pairs[i] = fmt.Sprintf("%s=\"%s\"", names[i], escape.Replace(v))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func value(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
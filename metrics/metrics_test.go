@@ -0,0 +1,46 @@
+package metrics_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/nanopack/shaman/metrics"
+)
+
+func TestWrite(t *testing.T) {
+	counter := metrics.NewCounterVec("test_requests_total", "Requests\nby code", "code")
+	counter.Inc("200")
+	counter.Add(2, "404")
+	counter.Inc("say \"hi\"")
+
+	histogram := metrics.NewHistogramVec("test_duration_seconds", "Durations", []float64{0.1, 1}, "op")
+	histogram.Observe(0.05, "get")
+	histogram.Observe(0.5, "get")
+	histogram.Observe(5, "get")
+
+	metrics.NewGaugeFunc("test_things", "Things", func() float64 { return 3 })
+
+	var out bytes.Buffer
+	metrics.Write(&out)
+
+	expected := `# HELP test_requests_total Requests\nby code
+# TYPE test_requests_total counter
+test_requests_total{code="200"} 1
+test_requests_total{code="404"} 2
+test_requests_total{code="say \"hi\""} 1
+# HELP test_duration_seconds Durations
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{op="get",le="0.1"} 1
+test_duration_seconds_bucket{op="get",le="1"} 2
+test_duration_seconds_bucket{op="get",le="+Inf"} 3
+test_duration_seconds_sum{op="get"} 5.55
+test_duration_seconds_count{op="get"} 3
+# HELP test_things Things
+# TYPE test_things gauge
+test_things 3
+`
+	if !strings.Contains(out.String(), expected) {
+		t.Errorf("Metrics don't match expected - %q", out.String())
+	}
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/nanopack/shaman/config"
+)
+
+// aclAllows returns whether ip is allowed by acl, a comma separated list of
+// ips, cidrs or `any`, each denying instead when prefixed with `!`. The first
+// entry that matches decides; ips matching none are denied, unless the list is
+// empty and open.
+func aclAllows(acl string, ip net.IP, open bool) bool {
+	if strings.TrimSpace(acl) == "" {
+		return open
+	}
+	if ip == nil {
+		return false
+	}
+
+	for _, entry := range strings.Split(acl, ",") {
+		entry = strings.TrimSpace(entry)
+		deny := strings.HasPrefix(entry, "!")
+		entry = strings.TrimSpace(strings.TrimPrefix(entry, "!"))
+		if entry == "" {
+			continue
+		}
+
+		matched := false
+		if strings.ToLower(entry) == "any" {
+			matched = true
+		} else if network := parseNetwork(entry); network != nil {
+			matched = network.Contains(ip)
+		} else {
+			config.Log.Debug("Bad acl entry '%s'", entry)
+		}
+		if matched {
+			return !deny
+		}
+	}
+	return false
+}
+
+// checkAcls returns an error for the first malformed entry of the configured
+// acls (which, first match winning, could let in clients it meant to deny)
+func checkAcls() error {
+	acls := []struct{ name, acl string }{
+		{"allow-query", config.AllowQuery},
+		{"allow-forward", config.AllowForward},
+		{"transfer-allow", config.TransferAllow},
+	}
+	for _, a := range acls {
+		for _, entry := range strings.Split(a.acl, ",") {
+			entry = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(entry), "!"))
+			if entry == "" || strings.ToLower(entry) == "any" || parseNetwork(entry) != nil {
+				continue
+			}
+			return fmt.Errorf("Bad %s entry '%s' - expected an ip, cidr or 'any'", a.name, entry)
+		}
+	}
+	return nil
+}
+
+// queryAllowed returns whether addr may query at all
+func queryAllowed(addr net.Addr) bool {
+	return aclAllows(config.AllowQuery, addrIP(addr), true)
+}
+
+// forwardAllowed returns whether queries from addr may be relayed to the
+// fallback servers
+func forwardAllowed(addr net.Addr) bool {
+	return aclAllows(config.AllowForward, addrIP(addr), true)
+}
+
+// transferAllowed returns whether addr may transfer the zone
+func transferAllowed(addr net.Addr) bool {
+	return aclAllows(config.TransferAllow, addrIP(addr), false)
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/nanopack/shaman/config"
+)
+
+// responses is the cache of fallback responses
+var responses = newResponseCache()
+
+// CacheStats describes the fallback response cache
+type CacheStats struct {
+	Size      int    `json:"size"`      // responses currently cached
+	Capacity  int    `json:"capacity"`  // most responses that will be cached
+	Hits      uint64 `json:"hits"`      // lookups answered from the cache
+	Misses    uint64 `json:"misses"`    // lookups that went upstream
+	Evictions uint64 `json:"evictions"` // responses dropped to make room
+	Expired   uint64 `json:"expired"`   // responses dropped because their ttl ran out
+}
+
+// responseCache is a bounded, least-recently-used cache of fallback responses
+// (positive and negative) that honors their ttls
+type responseCache struct {
+	sync.Mutex
+	entries map[cacheKey]*list.Element
+	lru     *list.List
+	stats   CacheStats
+}
+
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+	do     bool   // dnssec ok responses differ
+	cd     bool   // as do those left unvalidated
+	rd     bool   // and those to queries not wanting recursion
+	subnet string // and those for a forwarded client subnet (RFC 7871)
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+}
+
+func newResponseCache() *responseCache {
+	return &responseCache{entries: make(map[cacheKey]*list.Element), lru: list.New()}
+}
+
+// FlushCache empties the fallback response cache
+func FlushCache() {
+	responses.Lock()
+	responses.entries = make(map[cacheKey]*list.Element)
+	responses.lru.Init()
+	responses.Unlock()
+}
+
+// GetCacheStats returns the fallback response cache's counters
+func GetCacheStats() CacheStats {
+	responses.Lock()
+	defer responses.Unlock()
+	stats := responses.stats
+	stats.Size = responses.lru.Len()
+	stats.Capacity = config.FallBackCacheSize
+	return stats
+}
+
+// newCacheKey returns the key for query, and whether it can be cached at all
+func newCacheKey(query *dns.Msg) (cacheKey, bool) {
+	if config.FallBackCacheSize <= 0 || len(query.Question) != 1 {
+		return cacheKey{}, false
+	}
+	q := query.Question[0]
+	key := cacheKey{name: strings.ToLower(q.Name), qtype: q.Qtype, qclass: q.Qclass, cd: query.CheckingDisabled, rd: query.RecursionDesired}
+	if opt := query.IsEdns0(); opt != nil {
+		key.do = opt.Do()
+		for _, option := range opt.Option {
+			if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+				key.subnet = subnet.String()
+			}
+		}
+	}
+	return key, true
+}
+
+// get returns a copy of the cached response for key with its ttls counted
+// down, or nil if there isn't a fresh one
+func (self *responseCache) get(key cacheKey) *dns.Msg {
+	self.Lock()
+	defer self.Unlock()
+
+	element, ok := self.entries[key]
+	if !ok {
+		self.stats.Misses++
+		return nil
+	}
+
+	entry := element.Value.(*cacheEntry)
+	now := time.Now()
+	if !now.Before(entry.expires) {
+		self.lru.Remove(element)
+		delete(self.entries, key)
+		self.stats.Expired++
+		self.stats.Misses++
+		return nil
+	}
+
+	self.lru.MoveToFront(element)
+	self.stats.Hits++
+
+	r := entry.msg.Copy()
+	age := uint32(now.Sub(entry.stored) / time.Second)
+	for _, section := range [][]dns.RR{r.Answer, r.Ns, r.Extra} {
+		for _, rr := range section {
+			// the opt record's ttl holds flags, not a ttl
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if rr.Header().Ttl > age {
+				rr.Header().Ttl -= age
+			} else {
+				rr.Header().Ttl = 0
+			}
+		}
+	}
+	return r
+}
+
+// set caches r under key for as long as its records allow
+func (self *responseCache) set(key cacheKey, r *dns.Msg) {
+	ttl, ok := cacheTTL(r)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	entry := &cacheEntry{key: key, msg: r.Copy(), stored: now, expires: now.Add(ttl)}
+
+	self.Lock()
+	defer self.Unlock()
+
+	if element, ok := self.entries[key]; ok {
+		element.Value = entry
+		self.lru.MoveToFront(element)
+		return
+	}
+
+	self.entries[key] = self.lru.PushFront(entry)
+	for self.lru.Len() > config.FallBackCacheSize {
+		oldest := self.lru.Back()
+		self.lru.Remove(oldest)
+		delete(self.entries, oldest.Value.(*cacheEntry).key)
+		self.stats.Evictions++
+	}
+}
+
+// cacheTTL returns how long r may be cached: the lowest answer ttl, or for
+// negative answers the SOA's negative ttl (RFC 2308), capped by config
+func cacheTTL(r *dns.Msg) (time.Duration, bool) {
+	if r.Truncated || (r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError) {
+		return 0, false
+	}
+
+	ttl := uint32(config.FallBackCacheMaxTTL / time.Second)
+	found := false
+	if len(r.Answer) > 0 {
+		for _, rr := range r.Answer {
+			if rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+		found = true
+	} else {
+		// negative answers without an SOA aren't cacheable
+		for _, rr := range r.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				if soa.Hdr.Ttl < ttl {
+					ttl = soa.Hdr.Ttl
+				}
+				if soa.Minttl < ttl {
+					ttl = soa.Minttl
+				}
+				found = true
+				break
+			}
+		}
+	}
+
+	return time.Duration(ttl) * time.Second, found && ttl > 0
+}
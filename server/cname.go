@@ -0,0 +1,46 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/nanopack/shaman/config"
+)
+
+// maxCnameDepth is how many aliases will be followed before giving up
+const maxCnameDepth = 8
+
+// chaseCname follows the CNAME chain at the end of answers, appending each
+// target's records. Targets are looked up in shaman's own records first and
+// then (if outside of our zone) the fallback server.
+func chaseCname(from *requester, qtype uint16, answers []dns.RR) []dns.RR {
+	if qtype == dns.TypeCNAME || qtype == dns.TypeANY {
+		return answers
+	}
+
+	seen := make(map[string]bool)
+	for depth := 0; depth < maxCnameDepth; depth++ {
+		cname, ok := answers[len(answers)-1].(*dns.CNAME)
+		if !ok {
+			return answers
+		}
+
+		seen[strings.ToLower(cname.Hdr.Name)] = true
+		target := strings.ToLower(cname.Target)
+		if seen[target] {
+			config.Log.Debug("CNAME loop detected at '%v'", target)
+			return answers
+		}
+
+		config.Log.Trace("Chasing CNAME '%v' -> '%v'", cname.Hdr.Name, target)
+		next, _ := answerQuestion(from, qtype, target)
+		if len(next) == 0 {
+			return answers
+		}
+		answers = append(answers, next...)
+	}
+
+	config.Log.Debug("CNAME chain too long at '%v'", answers[len(answers)-1].Header().Name)
+	return answers
+}
@@ -0,0 +1,245 @@
+package server
+
+import (
+	"encoding/base32"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/nanopack/shaman/config"
+	"github.com/nanopack/shaman/core"
+)
+
+// denial returns the NSEC or NSEC3 records proving that name doesn't exist
+// (nxdomain), or has no records of the asked type. Records are generated on
+// the fly, tightly around name, so they reveal nothing else about the zone
+// (RFC 4470, RFC 7129). Only what view sees is proven.
+func denial(name, view string, nxdomain bool) []dns.RR {
+	name = strings.ToLower(dns.Fqdn(name))
+	if config.DnssecDenial == "nsec3" {
+		return nsec3Denial(name, view, nxdomain)
+	}
+	return nsecDenial(name, view, nxdomain)
+}
+
+// nsecDenial returns NSEC records covering name and the wildcard that could
+// have matched it, or matching name without the asked type
+func nsecDenial(name, view string, nxdomain bool) []dns.RR {
+	if !nxdomain {
+		return []dns.RR{nsec(name, "\\000."+name, append(typesAt(name, view), dns.TypeNSEC, dns.TypeRRSIG))}
+	}
+
+	wildcard := "*." + closestEncloser(name, view)
+	records := []dns.RR{nsec(predecessor(name), "\\000."+name, []uint16{dns.TypeNSEC, dns.TypeRRSIG})}
+	if wildcard != name {
+		records = append(records, nsec(predecessor(wildcard), "\\000."+wildcard, []uint16{dns.TypeNSEC, dns.TypeRRSIG}))
+	}
+	return records
+}
+
+// nsec3Denial returns NSEC3 records proving the closest encloser exists and
+// that neither the next closer name nor the wildcard do, or matching name
+// without the asked type (RFC 5155 7.2)
+func nsec3Denial(name, view string, nxdomain bool) []dns.RR {
+	if !nxdomain {
+		hash := nsec3Hash(name)
+		return []dns.RR{nsec3(hash, nextHash(hash, 1), signedTypes(typesAt(name, view)))}
+	}
+
+	encloser := closestEncloser(name, view)
+	labels := dns.SplitDomainName(name)
+	closer := dns.Fqdn(strings.Join(labels[len(labels)-dns.CountLabel(encloser)-1:], "."))
+
+	ce := nsec3Hash(encloser)
+	nc := nsec3Hash(closer)
+	wc := nsec3Hash("*." + encloser)
+	records := []dns.RR{
+		nsec3(ce, nextHash(ce, 1), signedTypes(typesAt(encloser, view))),
+		nsec3(nextHash(nc, -1), nextHash(nc, 1), nil),
+	}
+	if wc != nc {
+		records = append(records, nsec3(nextHash(wc, -1), nextHash(wc, 1), nil))
+	}
+	return records
+}
+
+// nsec returns an NSEC record
+func nsec(owner, next string, types []uint16) dns.RR {
+	return &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: owner, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: uint32(config.SoaMinimum)},
+		NextDomain: next,
+		TypeBitMap: sortTypes(types),
+	}
+}
+
+// nsec3 returns an NSEC3 record (sha1, no salt or extra iterations, RFC 9276)
+func nsec3(owner, next string, types []uint16) dns.RR {
+	return &dns.NSEC3{
+		Hdr:        dns.RR_Header{Name: strings.ToLower(owner) + "." + zone(), Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: uint32(config.SoaMinimum)},
+		Hash:       dns.SHA1,
+		HashLength: 20,
+		NextDomain: next,
+		TypeBitMap: sortTypes(types),
+	}
+}
+
+// nsec3param returns the zone's NSEC3PARAM record
+func nsec3param() dns.RR {
+	return &dns.NSEC3PARAM{
+		Hdr:  dns.RR_Header{Name: zone(), Rrtype: dns.TypeNSEC3PARAM, Class: dns.ClassINET, Ttl: 0},
+		Hash: dns.SHA1,
+	}
+}
+
+// nsec3Hash returns the (base32hex) NSEC3 hash of name
+func nsec3Hash(name string) string {
+	return dns.HashName(name, dns.SHA1, 0, "")
+}
+
+// nextHash returns hash plus (or minus) one
+func nextHash(hash string, delta int) string {
+	b, err := base32.HexEncoding.DecodeString(strings.ToUpper(hash))
+	if err != nil {
+		return hash
+	}
+	for i := len(b) - 1; i >= 0; i-- {
+		if delta > 0 {
+			b[i]++
+			if b[i] != 0 {
+				break
+			}
+		} else {
+			b[i]--
+			if b[i] != 0xff {
+				break
+			}
+		}
+	}
+	return base32.HexEncoding.EncodeToString(b)
+}
+
+// typesAt returns the types of the records at name, as served to view
+func typesAt(name, view string) []uint16 {
+	records := make([]dns.RR, 0)
+	if resource, err := shaman.GetRecord(name); err == nil {
+		if resource, err = viewResource(resource, view); err == nil {
+			records = resourceRecords(resource)
+		}
+	}
+
+	types := make([]uint16, 0)
+	for _, rr := range withApex(name, records) {
+		types = append(types, rr.Header().Rrtype)
+	}
+	if name == zone() {
+		types = append(types, dns.TypeDNSKEY)
+		if config.DnssecDenial == "nsec3" {
+			types = append(types, dns.TypeNSEC3PARAM)
+		}
+	}
+	return types
+}
+
+// signedTypes adds RRSIG to types if there are any (nothing is signed at an
+// empty non-terminal)
+func signedTypes(types []uint16) []uint16 {
+	if len(types) == 0 {
+		return types
+	}
+	return append(types, dns.TypeRRSIG)
+}
+
+// sortTypes returns types in order without duplicates, as type bitmaps need
+func sortTypes(types []uint16) []uint16 {
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	unique := make([]uint16, 0, len(types))
+	for i := range types {
+		if i == 0 || types[i] != types[i-1] {
+			unique = append(unique, types[i])
+		}
+	}
+	return unique
+}
+
+// closestEncloser returns the nearest ancestor of name that exists, which is
+// at most the zone apex, as seen from view
+func closestEncloser(name, view string) string {
+	for encloser := parent(name); encloser != "" && inZone(encloser); encloser = parent(encloser) {
+		if encloser == zone() || existsInView(encloser, view) || hasSubdomainInView(encloser, view) {
+			return encloser
+		}
+	}
+	return zone()
+}
+
+// predecessor returns a name just before name in canonical order (RFC 4034
+// 6.1), by decrementing the last octet of its first label and filling it out
+// with \255s (RFC 4470 2)
+func predecessor(name string) string {
+	labels := dns.SplitDomainName(name)
+	if len(labels) == 0 {
+		return name
+	}
+	rest := dns.Fqdn(strings.Join(labels[1:], "."))
+	if len(labels) == 1 {
+		rest = "."
+	}
+
+	label := unescape(labels[0])
+	last := label[len(label)-1]
+	label = label[:len(label)-1]
+	if last == 0 {
+		// `a\000` comes right after `a` (and its subdomains)
+		if len(label) == 0 {
+			return rest
+		}
+		return escape(label) + "." + strings.TrimPrefix(rest, ".")
+	}
+
+	// a label can hold 63 octets and a name 255
+	label = append(label, last-1)
+	room := 255 - (len(rest) + 1) - 1
+	for len(label) < 63 && len(label) < room {
+		label = append(label, 0xff)
+	}
+	return escape(label) + "." + strings.TrimPrefix(rest, ".")
+}
+
+// unescape returns the octets of a label in presentation format
+func unescape(label string) []byte {
+	octets := make([]byte, 0, len(label))
+	for i := 0; i < len(label); i++ {
+		if label[i] != '\\' || i+1 >= len(label) {
+			octets = append(octets, label[i])
+			continue
+		}
+		// \DDD is a decimal octet, \X is X
+		if i+4 <= len(label) {
+			if d, err := strconv.Atoi(label[i+1 : i+4]); err == nil && d < 256 {
+				octets = append(octets, byte(d))
+				i += 3
+				continue
+			}
+		}
+		octets = append(octets, label[i+1])
+		i++
+	}
+	return octets
+}
+
+// escape returns octets as a label in presentation format
+func escape(octets []byte) string {
+	label := ""
+	for _, b := range octets {
+		switch {
+		case b >= 'a' && b <= 'z', b >= '0' && b <= '9', b == '-', b == '_':
+			label += string(b)
+		default:
+			label += fmt.Sprintf("\\%03d", b)
+		}
+	}
+	return label
+}
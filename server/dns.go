@@ -3,78 +3,367 @@ package server
 
 import (
 	"fmt"
+	"net"
 	"strings"
+	"sync"
 
 	"github.com/miekg/dns"
 
 	"github.com/nanopack/shaman/config"
 	"github.com/nanopack/shaman/core"
-	sham "github.com/nanopack/shaman/core/common"
 )
 
-// Start starts the DNS listener
+// Start starts the DNS listeners (udp, tcp and optionally tls). If any
+// listener stops, the others are shut down as well.
 func Start() error {
+	if err := loadSettings(); err != nil {
+		return err
+	}
+
 	dns.HandleFunc(".", handlerFunc)
-	udpListener := &dns.Server{Addr: config.DnsListen, Net: "udp"}
-	config.Log.Info("DNS listening at udp://%v", config.DnsListen)
-	return fmt.Errorf("DNS listener stopped - %v", udpListener.ListenAndServe())
+
+	listeners := []*dns.Server{
+		{Addr: config.DnsListen, Net: "udp", TsigSecret: tsigSecrets(), MsgAcceptFunc: acceptMsg},
+		{Addr: config.DnsListen, Net: "tcp", TsigSecret: tsigSecrets(), MsgAcceptFunc: acceptMsg},
+	}
+
+	tlsListener, err := tlsListener()
+	if err != nil {
+		return err
+	}
+	if tlsListener != nil {
+		listeners = append(listeners, tlsListener)
+	}
+
+	if config.Dnssec {
+		if _, err := getKeys(); err != nil {
+			return fmt.Errorf("Failed to load dnssec keys - %v", err)
+		}
+		for _, ds := range dsRecords() {
+			config.Log.Info("DS for the parent zone - %s", ds.String())
+		}
+	}
+
+	if config.QueryLog != "" {
+		if err := SetQueryLog(true, nil); err != nil {
+			return err
+		}
+	}
+
+	go checkUpstreams()
+	go syncChecks()
+	shaman.OnChange(func(uint32) { go syncChecks() })
+	shaman.OnChange(func(uint32) { go names.rebuild() })
+	shaman.OnChange(notifySecondaries)
+
+	errs := make(chan error, len(listeners))
+	for i := range listeners {
+		go func(listener *dns.Server) {
+			config.Log.Info("DNS listening at %v://%v", listener.Net, listener.Addr)
+			errs <- fmt.Errorf("%v - %v", listener.Net, listener.ListenAndServe())
+		}(listeners[i])
+	}
+
+	// block until one stops, then bring the rest down with it
+	err = <-errs
+	for i := range listeners {
+		listeners[i].Shutdown()
+	}
+
+	return fmt.Errorf("DNS listener stopped - %v", err)
+}
+
+// loadSettings parses the config the queries rely on, while none are answered.
+func loadSettings() error {
+	settings.Lock()
+	defer settings.Unlock()
+
+	if err := loadTsigKeys(); err != nil {
+		return err
+	}
+	if err := loadRegions(); err != nil {
+		return err
+	}
+	if err := checkAcls(); err != nil {
+		return err
+	}
+	if err := checkFallBackPolicy(); err != nil {
+		return err
+	}
+	if err := checkPrefixes(); err != nil {
+		return err
+	}
+	return loadViews()
+}
+
+// settings orders changes made to the config while serving (as the tests do)
+// with the queries reading it
+var settings sync.RWMutex
+
+// Configure runs fn, which may change the config, while no query is being
+// answered.
+func Configure(fn func()) {
+	settings.Lock()
+	defer settings.Unlock()
+	fn()
+}
+
+// ServeDNS answers req just as the DNS listeners would, writing the response to
+// res. It lets other transports (like the api's DNS-over-HTTPS) share the logic.
+func ServeDNS(res dns.ResponseWriter, req *dns.Msg) {
+	handlerFunc(res, req)
 }
 
 // handlerFunc receives requests, looks up the result and returns what is found.
 func handlerFunc(res dns.ResponseWriter, req *dns.Msg) {
+	settings.RLock()
+	defer settings.RUnlock()
+
+	from := &requester{source: sourceLocal}
+	res = countQueries(res, req)
+	res = logQueries(res, req, from)
+	tapClientQuery(res, req)
+
+	// udp source addresses are easily spoofed, so floods are dropped there
+	_, udp := res.RemoteAddr().(*net.UDPAddr)
+	if udp && !allowQuery(res.RemoteAddr()) {
+		return
+	}
+
+	// signed requests must verify, whatever they ask (RFC 2845 4.5)
+	if req.IsTsig() != nil {
+		if _, ok := signedBy(res, req); !ok {
+			res.WriteMsg(new(dns.Msg).SetRcode(req, dns.RcodeNotAuth))
+			return
+		}
+	}
+
+	// unsigned requests are subject to the query acl (signed ones are let
+	// through, their keys say what they may do)
+	if req.IsTsig() == nil && !queryAllowed(res.RemoteAddr()) {
+		config.Log.Debug("Refused query from %v", res.RemoteAddr())
+		res.WriteMsg(new(dns.Msg).SetRcode(req, dns.RcodeRefused))
+		return
+	}
+
+	// we only speak EDNS version 0 (RFC 6891)
+	if rcode := checkEdns0(req); rcode != dns.RcodeSuccess {
+		message := new(dns.Msg).SetRcode(req, rcode)
+		setEdns0(res, req, message, 0)
+		res.WriteMsg(message)
+		return
+	}
+
+	from.subnet, from.forward, from.view = clientSubnet(res, req), forwardAllowed(res.RemoteAddr()), selectView(res, req)
+	if len(req.Question) > 0 {
+		config.Log.Trace("%v asked for '%s' %s (client subnet %v)", res.RemoteAddr(), req.Question[0].Name,
+			dns.TypeToString[req.Question[0].Qtype], from.subnet)
+	}
+
 	message := new(dns.Msg)
 	switch req.Opcode {
 	case dns.OpcodeQuery:
+		// zone transfers for secondaries
+		if len(req.Question) == 1 && (req.Question[0].Qtype == dns.TypeAXFR || req.Question[0].Qtype == dns.TypeIXFR) {
+			transfer(res, req)
+			return
+		}
+
+		// names we know nothing about are relayed to the fallback server as is
+		if len(req.Question) == 1 && forwardable(req.Question[0].Name, from.view) {
+			if !from.forward {
+				message.SetRcode(req, dns.RcodeRefused)
+				break
+			}
+			message = forward(req)
+			from.source = sourceFallback
+			break
+		}
+
 		message.SetReply(req)
 		message.Compress = false
 		message.Answer = make([]dns.RR, 0)
 
 		for _, question := range message.Question {
-			answers := answerQuestion(question.Qtype, strings.ToLower(question.Name))
+			name := strings.ToLower(question.Name)
+
+			// outside of our zone, forward if we can, otherwise refuse
+			if zone() != "" && !inZone(name) && (config.DnsFallBack == "" || !from.forward) {
+				message.Rcode = dns.RcodeRefused
+				continue
+			}
+			// we are the authority for anything within our zone
+			if inZone(name) {
+				message.Authoritative = true
+			}
+
+			answers, exists := answerQuestion(from, question.Qtype, name)
 			if len(answers) > 0 {
+				answers = chaseCname(from, question.Qtype, answers)
 				for i := range answers {
 					message.Answer = append(message.Answer, answers[i])
 				}
-			} else {
-				// If there are no records, go back through and search for SOA records
-				for _, question := range message.Question {
-					answers := answerQuestion(dns.TypeSOA, strings.ToLower(question.Name))
-					for i := range answers {
-						message.Ns = append(message.Ns, answers[i])
-					}
-				}
+				continue
+			}
+
+			// the name may exist without the requested type (NODATA), or be an
+			// empty non-terminal (RFC 8020); otherwise it truly doesn't exist
+			nxdomain := !exists && !hasSubdomainInView(name, from.view)
+			if nxdomain {
+				message.Rcode = dns.RcodeNameError
+			}
+
+			// negative answers carry the SOA so resolvers can cache them (RFC 2308)
+			if auth := negativeSoa(name); auth != nil {
+				message.Ns = append(message.Ns, auth)
+			}
+			// and proof of it, for those that validate
+			if dnssecOk(req) && inZone(name) {
+				message.Ns = append(message.Ns, denial(name, from.view, nxdomain)...)
 			}
 		}
-		if len(message.Answer) == 0 && len(message.Ns) == 0 {
-			message.Rcode = dns.RcodeNameError
-		}
+	case dns.OpcodeUpdate:
+		message = update(res, req)
 	default:
 		message = message.SetRcode(req, dns.RcodeNotImplemented)
 	}
+
+	if dnssecOk(req) {
+		signMessage(message)
+	}
+	setEdns0(res, req, message, from.scope)
+
+	if udp {
+		// udp responses must fit in the client's buffer
+		truncate(message, udpSize(req))
+
+		// and can't be repeated fast enough for an amplification attack
+		switch rrl(res.RemoteAddr(), message) {
+		case rrlDrop:
+			return
+		case rrlSlip:
+			message = slipped(req)
+		}
+	}
+
+	sign(res, req, message)
 	res.WriteMsg(message)
 }
 
+// truncate drops records from the response until it fits in size bytes,
+// setting the TC bit so the client knows to retry over tcp.
+func truncate(message *dns.Msg, size int) {
+	if msgSize(message) <= size {
+		return
+	}
+
+	// keep the OPT record, it describes the response
+	message.Truncated = true
+	opt := message.IsEdns0()
+	message.Extra = nil
+	if opt != nil {
+		message.Extra = []dns.RR{opt}
+	}
+	for len(message.Ns) > 0 && msgSize(message) > size {
+		message.Ns = message.Ns[:len(message.Ns)-1]
+	}
+	for len(message.Answer) > 0 && msgSize(message) > size {
+		message.Answer = message.Answer[:len(message.Answer)-1]
+	}
+}
+
+// msgSize returns the packed size of message. Len is only an estimate (it
+// overcounts escaped names), so anything it thinks is too big gets packed.
+func msgSize(message *dns.Msg) int {
+	if n := message.Len(); n <= dns.MinMsgSize {
+		return n
+	}
+	b, err := message.Copy().Pack()
+	if err != nil {
+		return message.Len()
+	}
+	return len(b)
+}
+
+// negativeSoa returns the SOA to put in the authority section of a negative
+// answer for name, with its ttl capped to the SOA minimum (RFC 2308).
+func negativeSoa(name string) dns.RR {
+	var auth dns.RR
+	if inZone(name) {
+		auth = soa()
+	} else {
+		// look for a stored SOA at or above name
+		for qName := name; qName != "" && auth == nil; qName = stripSubdomain(qName) {
+			r, err := shaman.GetRecord(qName)
+			if err != nil {
+				continue
+			}
+			for _, record := range r.StringSlice() {
+				entry, err := dns.NewRR(record)
+				if err == nil && entry.Header().Rrtype == dns.TypeSOA {
+					auth = entry
+					break
+				}
+			}
+		}
+	}
+	if auth == nil {
+		return nil
+	}
+
+	if minttl := auth.(*dns.SOA).Minttl; auth.Header().Ttl > minttl {
+		auth.Header().Ttl = minttl
+	}
+	return auth
+}
+
 // answerQuestion returns resource record answers for the domain in question
-func answerQuestion(qtype uint16, name ...string) []dns.RR {
+// (those meant for the requester), and whether the domain exists at all (to
+// tell NODATA from NXDOMAIN)
+func answerQuestion(from *requester, qtype uint16, name ...string) ([]dns.RR, bool) {
 	answers := make([]dns.RR, 0)
 	qName := name[len(name)-1] // either `len` every time, or use var
 
-	// get the resource (check memory, cache, and upstream)
+	// get the resource (check memory, cache, and upstream), as the requester's
+	// view sees it
 	r, err := shaman.GetRecord(qName)
+	if err == nil {
+		r, err = viewResource(r, from.view)
+	}
+	if err != nil && !config.ImplicitWildcard {
+		// synthesize from a wildcard if the name doesn't exist
+		if wildcard, werr := wildcardRecord(qName, from.view); werr == nil {
+			r, err = viewResource(wildcard, from.view)
+			if err == nil {
+				from.source = sourceWildcard
+			}
+		}
+	}
 	if err != nil {
-		// fetch from fallback server if fallback dns server is provided
-		if config.DnsFallBack != "" {
+		// fetch from fallback server if fallback dns server is provided (we
+		// never forward for our own zone, or for parents of the name)
+		if config.DnsFallBack != "" && from.forward && !inZone(qName) && len(name) == 1 {
 			config.Log.Trace("Getting records for '%s' from fallback dns server '%s'", qName, config.DnsFallBack)
-			if resource, err := getAnswerFromFallBackServer(qName, config.DnsFallBack); err != nil {
+			answers, err := getAnswerFromFallBackServer(qName, qtype)
+			if err != nil {
 				config.Log.Trace("Failed to get records for '%s' from fallback dns server - %v", qName, err)
-			} else {
-				r = resource
+			} else if len(answers) > 0 {
+				from.source = sourceFallback
+				return answers, true
 			}
 		} else {
 			config.Log.Trace("Failed to get records for '%s' - %v", qName, err)
 		}
 	}
 
+	apex := qName == zone() && name[0] == qName
+	exists := apex || len(r.Records) > 0
+	r.Records = healthyRecords(r)
+	r.Records = localRecords(r.Records, from)
+	r.Records = applyPolicy(r)
+	storedNs := false
+	var cname dns.RR
+
 	// validate the records and append correct type to answers[]
 	for _, record := range r.StringSlice() {
 		entry, err := dns.NewRR(record)
@@ -82,23 +371,47 @@ func answerQuestion(qtype uint16, name ...string) []dns.RR {
 			config.Log.Debug("Failed to create RR from record - %v", err)
 			continue
 		}
+		// the apex SOA is always synthesized
+		if apex && entry.Header().Rrtype == dns.TypeSOA {
+			continue
+		}
+		if entry.Header().Rrtype == dns.TypeNS {
+			storedNs = true
+		}
 		entry.Header().Name = name[0]
 		if entry.Header().Rrtype == qtype || qtype == dns.TypeANY {
 			answers = append(answers, entry)
+		} else if entry.Header().Rrtype == dns.TypeCNAME && cname == nil {
+			cname = entry
 		}
 	}
 
-	// recursively resolve if no records found (essentially provides wildcard
-	// registration support)
-	if len(answers) == 0 {
+	// an alias answers for any type it doesn't have itself (the caller chases it)
+	if len(answers) == 0 && cname != nil {
+		answers = append(answers, cname)
+	}
+
+	if apex {
+		for _, entry := range apexRecords(qtype) {
+			if entry.Header().Rrtype == dns.TypeNS && storedNs {
+				continue
+			}
+			answers = append(answers, entry)
+		}
+	}
+
+	// recursively resolve with the parent domain if no records found (legacy
+	// implicit wildcard support), without leaving our zone
+	if len(answers) == 0 && config.ImplicitWildcard {
 		qName = stripSubdomain(qName)
-		if len(qName) > 0 {
+		if len(qName) > 0 && (!inZone(name[0]) || inZone(qName)) {
 			config.Log.Trace("Checking again with '%v'", qName)
-			return answerQuestion(qtype, name[0], qName)
+			answers, found := answerQuestion(from, qtype, name[0], qName)
+			return answers, exists || found
 		}
 	}
 
-	return answers
+	return answers, exists
 }
 
 // stripSubdomain strips off the subbest domain, returning the domain (won't return TLD)
@@ -119,35 +432,3 @@ func stripSubdomain(name string) string {
 	}
 	return ""
 }
-
-// getAnswerFromFallBackServer gets record from the fallback dns server
-func getAnswerFromFallBackServer(qName string, fallBackServer string) (sham.Resource, error) {
-	resource := sham.Resource{}
-	records := []sham.Record{}
-
-	c := new(dns.Client)
-	m := new(dns.Msg)
-	m.SetQuestion(dns.Fqdn(qName), dns.TypeA)
-	m.RecursionDesired = true
-
-	r, _, err := c.Exchange(m, fallBackServer)
-	if err != nil {
-		return resource, err
-	}
-
-	resource.Domain = qName
-	for _, r1 := range r.Answer {
-		record := sham.Record{}
-
-		record.TTL = int(r1.Header().Ttl)
-		record.RType = dns.Class(r1.Header().Class).String()
-		record.RType = dns.Type(r1.Header().Rrtype).String()
-		// for getting address
-		data := strings.Split(r1.String(), "\t")
-		record.Address = data[len(data)-1]
-
-		records = append(records, record)
-	}
-	resource.Records = records
-	return resource, nil
-}
@@ -1,8 +1,19 @@
 package server_test
 
 import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -12,6 +23,7 @@ import (
 	"github.com/nanopack/shaman/config"
 	"github.com/nanopack/shaman/core"
 	sham "github.com/nanopack/shaman/core/common"
+	"github.com/nanopack/shaman/metrics"
 	"github.com/nanopack/shaman/server"
 )
 
@@ -20,6 +32,10 @@ var nanopack = sham.Resource{Domain: "nanopack.io.", Records: []sham.Record{{Add
 func TestMain(m *testing.M) {
 	// manually configure
 	config.DnsListen = "127.0.0.1:8053"
+	config.DnsTlsListen = "127.0.0.1:8853"
+	config.TsigKeys = "update.key:c2VjcmV0, Other.Key:c2VjcmV0, hmac-sha512:xfr.key:c2VjcmV0"
+	config.Regions = "eu=10.2.0.0/16"
+	config.Views = "internal=key:other.key, external=127.0.0.0/8"
 	config.Log = lumber.NewConsoleLogger(lumber.LvlInt("FATAL"))
 
 	// start dns server
@@ -66,7 +82,7 @@ func TestDNS(t *testing.T) {
 		t.Error("Found non-existant record")
 	}
 	// test fallback
-	config.DnsFallBack = "8.8.8.8:53"
+	server.Configure(func() { config.DnsFallBack = "8.8.8.8:53" })
 	r, err = ResolveIt("www.google.com", dns.TypeA)
 	if err != nil {
 		t.Errorf("Failed to get record - %v", err)
@@ -76,13 +92,1652 @@ func TestDNS(t *testing.T) {
 	}
 
 	// reset fallback
-	config.DnsFallBack = ""
+	server.Configure(func() { config.DnsFallBack = "" })
 	r, err = ResolveIt("www.google.com", dns.TypeA)
 	if len(r.Answer) != 0 {
 		t.Error("answer found for unregistered domain when fallback is off.")
 	}
 }
 
+func TestAuthoritative(t *testing.T) {
+	server.Configure(func() {
+		config.Domain = "nanopack.io"
+		config.SoaHostmaster = "admin@nanopack.io"
+	})
+	defer server.Configure(func() {
+		config.Domain = "."
+		config.SoaHostmaster = ""
+	})
+
+	err := shaman.AddRecord(&nanopack)
+	if err != nil {
+		t.Errorf("Failed to add record - %v", err)
+		t.FailNow()
+	}
+
+	// synthesized apex records
+	r, err := ResolveIt("nanopack.io", dns.TypeSOA)
+	if err != nil {
+		t.Errorf("Failed to get record - %v", err)
+		t.FailNow()
+	}
+	if !r.Authoritative {
+		t.Error("In-zone answer not authoritative")
+	}
+	if len(r.Answer) != 1 {
+		t.Errorf("Expected 1 SOA, got %d", len(r.Answer))
+	} else if soa, ok := r.Answer[0].(*dns.SOA); !ok || soa.Ns != "ns1.nanopack.io." || soa.Mbox != "admin.nanopack.io." {
+		t.Errorf("Bad SOA - %q", r.Answer[0].String())
+	}
+
+	r, err = ResolveIt("nanopack.io", dns.TypeNS)
+	if err != nil {
+		t.Errorf("Failed to get record - %v", err)
+		t.FailNow()
+	}
+	if len(r.Answer) != 1 || r.Answer[0].Header().Rrtype != dns.TypeNS {
+		t.Errorf("Expected synthesized NS - %v", r.Answer)
+	}
+
+	// stored records are still authoritative
+	r, err = ResolveIt("nanopack.io", dns.TypeA)
+	if err != nil {
+		t.Errorf("Failed to get record - %v", err)
+		t.FailNow()
+	}
+	if !r.Authoritative || len(r.Answer) != 1 {
+		t.Errorf("Expected authoritative A answer - %v", r)
+	}
+
+	// outside of the zone with no fallback
+	r, err = ResolveIt("nanobox.io", dns.TypeA)
+	if err != nil {
+		t.Errorf("Failed to get record - %v", err)
+		t.FailNow()
+	}
+	if r.Rcode != dns.RcodeRefused || r.Authoritative {
+		t.Errorf("Expected REFUSED for out of zone query, got %v", dns.RcodeToString[r.Rcode])
+	}
+}
+
+func TestNegativeAnswers(t *testing.T) {
+	server.Configure(func() { config.Domain = "shaman.test" })
+	defer server.Configure(func() { config.Domain = "." })
+
+	deep := sham.Resource{Domain: "a.b.shaman.test.", Records: []sham.Record{{Address: "127.0.0.1"}}}
+	err := shaman.AddRecord(&deep)
+	if err != nil {
+		t.Errorf("Failed to add record - %v", err)
+		t.FailNow()
+	}
+
+	tests := []struct {
+		domain string
+		rtype  uint16
+		rcode  int
+	}{
+		{"a.b.shaman.test", dns.TypeAAAA, dns.RcodeSuccess},  // exists without the type
+		{"b.shaman.test", dns.TypeA, dns.RcodeSuccess},       // empty non-terminal
+		{"c.shaman.test", dns.TypeA, dns.RcodeNameError},     // doesn't exist
+		{"c.a.b.shaman.test", dns.TypeA, dns.RcodeNameError}, // no implicit wildcard
+	}
+
+	for _, tt := range tests {
+		r, err := ResolveIt(tt.domain, tt.rtype)
+		if err != nil {
+			t.Errorf("Failed to get record - %v", err)
+			continue
+		}
+		if r.Rcode != tt.rcode {
+			t.Errorf("%s: expected %s, got %s", tt.domain, dns.RcodeToString[tt.rcode], dns.RcodeToString[r.Rcode])
+		}
+		if len(r.Answer) > 0 {
+			continue
+		}
+		if len(r.Ns) != 1 || r.Ns[0].Header().Rrtype != dns.TypeSOA {
+			t.Errorf("%s: expected SOA in authority section - %v", tt.domain, r.Ns)
+			continue
+		}
+		if r.Ns[0].Header().Name != "shaman.test." || r.Ns[0].Header().Ttl > uint32(config.SoaMinimum) {
+			t.Errorf("%s: bad negative SOA - %q", tt.domain, r.Ns[0].String())
+		}
+	}
+
+	// the empty non-terminal goes with the domain beneath it
+	shaman.DeleteRecord("a.b.shaman.test.")
+	r, err := ResolveIt("b.shaman.test", dns.TypeA)
+	if err != nil {
+		t.Errorf("Failed to get record - %v", err)
+		t.FailNow()
+	}
+	if r.Rcode != dns.RcodeNameError {
+		t.Errorf("Expected NXDOMAIN once the subdomain is deleted, got %s", dns.RcodeToString[r.Rcode])
+	}
+}
+
+func TestWildcard(t *testing.T) {
+	shaman.AddRecord(&sham.Resource{Domain: "*.wild.test.", Records: []sham.Record{{Address: "10.0.0.1"}}})
+	shaman.AddRecord(&sham.Resource{Domain: "host.wild.test.", Records: []sham.Record{{Address: "10.0.0.2"}}})
+	shaman.AddRecord(&sham.Resource{Domain: "a.sub.wild.test.", Records: []sham.Record{{Address: "10.0.0.3"}}})
+
+	tests := []struct {
+		domain  string
+		rtype   uint16
+		rcode   int
+		address string
+	}{
+		{"foo.wild.test", dns.TypeA, dns.RcodeSuccess, "10.0.0.1"},  // wildcard match
+		{"x.y.wild.test", dns.TypeA, dns.RcodeSuccess, "10.0.0.1"},  // closest encloser is wild.test
+		{"host.wild.test", dns.TypeA, dns.RcodeSuccess, "10.0.0.2"}, // existing names win
+		{"host.wild.test", dns.TypeAAAA, dns.RcodeSuccess, ""},      // ...even without the type
+		{"sub.wild.test", dns.TypeA, dns.RcodeSuccess, ""},          // empty non-terminals block wildcards
+		{"b.sub.wild.test", dns.TypeA, dns.RcodeNameError, ""},      // closest encloser is sub.wild.test
+		{"foo.wild.test", dns.TypeAAAA, dns.RcodeSuccess, ""},       // wildcard without the type
+	}
+
+	for _, tt := range tests {
+		r, err := ResolveIt(tt.domain, tt.rtype)
+		if err != nil {
+			t.Errorf("Failed to get record - %v", err)
+			continue
+		}
+		if r.Rcode != tt.rcode {
+			t.Errorf("%s: expected %s, got %s", tt.domain, dns.RcodeToString[tt.rcode], dns.RcodeToString[r.Rcode])
+		}
+		if tt.address == "" {
+			if len(r.Answer) != 0 {
+				t.Errorf("%s: unexpected answer - %v", tt.domain, r.Answer)
+			}
+			continue
+		}
+		if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != tt.address {
+			t.Errorf("%s: expected %s - %v", tt.domain, tt.address, r.Answer)
+			continue
+		}
+		if r.Answer[0].Header().Name != tt.domain+"." {
+			t.Errorf("%s: wildcard owner not replaced - %q", tt.domain, r.Answer[0].String())
+		}
+	}
+
+	// legacy parent domain fallthrough is opt-in
+	shaman.AddRecord(&nanopack)
+	r, _ := ResolveIt("a.b.nanopack.io", dns.TypeA)
+	if r == nil || len(r.Answer) != 0 {
+		t.Error("Found answer without implicit wildcards enabled")
+	}
+	server.Configure(func() { config.ImplicitWildcard = true })
+	r, _ = ResolveIt("a.b.nanopack.io", dns.TypeA)
+	server.Configure(func() { config.ImplicitWildcard = false })
+	if r == nil || len(r.Answer) == 0 {
+		t.Error("No answer with implicit wildcards enabled")
+	}
+}
+
+func TestCname(t *testing.T) {
+	shaman.AddRecord(&sham.Resource{Domain: "www.alias.test.", Records: []sham.Record{{RType: "CNAME", Address: "web.alias.test."}}})
+	shaman.AddRecord(&sham.Resource{Domain: "web.alias.test.", Records: []sham.Record{{RType: "CNAME", Address: "host.alias.test."}}})
+	shaman.AddRecord(&sham.Resource{Domain: "host.alias.test.", Records: []sham.Record{{Address: "10.1.1.1"}}})
+	shaman.AddRecord(&sham.Resource{Domain: "loop1.alias.test.", Records: []sham.Record{{RType: "CNAME", Address: "loop2.alias.test."}}})
+	shaman.AddRecord(&sham.Resource{Domain: "loop2.alias.test.", Records: []sham.Record{{RType: "CNAME", Address: "loop1.alias.test."}}})
+
+	// chain is followed to the address
+	r, err := ResolveIt("www.alias.test", dns.TypeA)
+	if err != nil {
+		t.Errorf("Failed to get record - %v", err)
+		t.FailNow()
+	}
+	if len(r.Answer) != 3 {
+		t.Errorf("Expected 2 CNAMEs and an A - %v", r.Answer)
+	} else if a, ok := r.Answer[2].(*dns.A); !ok || a.A.String() != "10.1.1.1" || a.Hdr.Name != "host.alias.test." {
+		t.Errorf("Bad chased answer - %q", r.Answer[2].String())
+	}
+
+	// asking for the alias itself doesn't chase
+	r, err = ResolveIt("www.alias.test", dns.TypeCNAME)
+	if err != nil {
+		t.Errorf("Failed to get record - %v", err)
+		t.FailNow()
+	}
+	if len(r.Answer) != 1 {
+		t.Errorf("Expected only the CNAME - %v", r.Answer)
+	}
+
+	// loops terminate
+	r, err = ResolveIt("loop1.alias.test", dns.TypeA)
+	if err != nil {
+		t.Errorf("Failed to get record - %v", err)
+		t.FailNow()
+	}
+	if len(r.Answer) != 2 {
+		t.Errorf("Expected each looping CNAME once - %v", r.Answer)
+	}
+}
+
+func TestForward(t *testing.T) {
+	upstream := startUpstream(t, "127.0.0.1:8054")
+	defer upstream.Shutdown()
+
+	server.Configure(func() { config.DnsFallBack = "127.0.0.1:8054" })
+	defer server.Configure(func() { config.DnsFallBack = "" })
+
+	// the original question type is relayed
+	r, err := ResolveIt("up.stream", dns.TypeAAAA)
+	if err != nil {
+		t.Errorf("Failed to get record - %v", err)
+		t.FailNow()
+	}
+	if len(r.Answer) != 1 || r.Answer[0].Header().Rrtype != dns.TypeAAAA {
+		t.Errorf("Expected upstream AAAA - %v", r.Answer)
+	}
+
+	// rcode and authority section are preserved
+	r, err = ResolveIt("missing.stream", dns.TypeMX)
+	if err != nil {
+		t.Errorf("Failed to get record - %v", err)
+		t.FailNow()
+	}
+	if r.Rcode != dns.RcodeNameError || len(r.Ns) != 1 || r.Ns[0].Header().Rrtype != dns.TypeSOA {
+		t.Errorf("Expected upstream NXDOMAIN with SOA - %v", r)
+	}
+
+	// dnssec ok bit makes it upstream
+	m := new(dns.Msg)
+	m.SetQuestion("do.stream.", dns.TypeTXT)
+	m.SetEdns0(4096, true)
+	r, err = dns.Exchange(m, config.DnsListen)
+	if err != nil {
+		t.Errorf("Failed to exchange - %v", err)
+		t.FailNow()
+	}
+	if len(r.Answer) != 1 || r.Answer[0].(*dns.TXT).Txt[0] != "do=true" {
+		t.Errorf("DO bit not forwarded - %v", r.Answer)
+	}
+}
+
+func TestAcl(t *testing.T) {
+	err := shaman.AddRecord(&nanopack)
+	if err != nil {
+		t.Errorf("Failed to add record - %v", err)
+		t.FailNow()
+	}
+	upstream := startUpstream(t, "127.0.0.1:8054")
+	defer upstream.Shutdown()
+	server.Configure(func() { config.DnsFallBack = "127.0.0.1:8054" })
+
+	tests := []struct {
+		query   string
+		forward string
+		domain  string
+		rcode   int
+	}{
+		{"", "", "nanopack.io", dns.RcodeSuccess},
+		{"", "", "up.stream", dns.RcodeSuccess},
+		{"10.0.0.0/8", "", "nanopack.io", dns.RcodeRefused},
+		{"!127.0.0.1, any", "", "nanopack.io", dns.RcodeRefused},
+		{"!10.0.0.0/8, 127.0.0.0/8", "", "nanopack.io", dns.RcodeSuccess},
+		{"", "10.0.0.0/8", "up.stream", dns.RcodeRefused},
+		{"", "10.0.0.0/8", "nanopack.io", dns.RcodeSuccess},
+		{"", "127.0.0.1", "up.stream", dns.RcodeSuccess},
+	}
+	for _, tt := range tests {
+		server.Configure(func() { config.AllowQuery, config.AllowForward = tt.query, tt.forward })
+		r, err := ResolveIt(tt.domain, dns.TypeAAAA)
+		if err != nil {
+			t.Errorf("Failed to get record - %v", err)
+			continue
+		}
+		if r.Rcode != tt.rcode {
+			t.Errorf("Expected %s for '%s' with acls '%s' and '%s', got %s", dns.RcodeToString[tt.rcode],
+				tt.domain, tt.query, tt.forward, dns.RcodeToString[r.Rcode])
+		}
+	}
+
+	server.Configure(func() { config.AllowQuery, config.AllowForward, config.DnsFallBack = "", "", "" })
+	shaman.DeleteRecord("nanopack.io.")
+
+	// a malformed entry keeps the server from starting
+	server.Configure(func() { config.AllowQuery = "!10.0.0.0/33, any" })
+	err = server.Start()
+	server.Configure(func() { config.AllowQuery = "" })
+	if err == nil || !strings.Contains(err.Error(), "allow-query") {
+		t.Errorf("Expected a bad acl error, got %v", err)
+	}
+}
+
+func TestUpstreams(t *testing.T) {
+	upstream := startUpstream(t, "127.0.0.1:8054")
+	defer upstream.Shutdown()
+
+	// nothing listens on 8055
+	server.Configure(func() { config.DnsFallBack = "127.0.0.1:8055@100ms, 127.0.0.1:8054" })
+	defer server.Configure(func() {
+		config.DnsFallBack = ""
+		config.FallBackPolicy = "sequential"
+	})
+
+	for _, policy := range []string{"sequential", "round-robin", "fastest"} {
+		server.Configure(func() { config.FallBackPolicy = policy })
+		for i := 0; i < 4; i++ {
+			r, err := ResolveIt("up.stream", dns.TypeAAAA)
+			if err != nil {
+				t.Errorf("%s: failed to get record - %v", policy, err)
+				continue
+			}
+			if len(r.Answer) != 1 {
+				t.Errorf("%s: dead upstream not skipped - %v", policy, r)
+			}
+		}
+	}
+
+	// servers answering SERVFAIL or REFUSED are passed over too, their reply only
+	// given when every server fails
+	var rcode int32
+	handler := func(res dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(req, int(atomic.LoadInt32(&rcode)))
+		res.WriteMsg(m)
+	}
+	started := make(chan struct{})
+	failing := &dns.Server{Addr: "127.0.0.1:8057", Net: "udp", Handler: dns.HandlerFunc(handler), NotifyStartedFunc: func() { close(started) }}
+	go failing.ListenAndServe()
+	<-started
+	defer failing.Shutdown()
+
+	server.Configure(func() { config.FallBackPolicy = "sequential" })
+	for _, code := range []int{dns.RcodeServerFailure, dns.RcodeRefused} {
+		atomic.StoreInt32(&rcode, int32(code))
+		server.Configure(func() { config.DnsFallBack = "127.0.0.1:8057, 127.0.0.1:8054" })
+		server.FlushCache()
+		r, err := ResolveIt("up.stream", dns.TypeAAAA)
+		if err != nil {
+			t.Errorf("Failed to get record - %v", err)
+			continue
+		}
+		if len(r.Answer) != 1 {
+			t.Errorf("Upstream answering %s not skipped - %v", dns.RcodeToString[code], r)
+		}
+
+		server.Configure(func() { config.DnsFallBack = "127.0.0.1:8057" })
+		server.FlushCache()
+		r, err = ResolveIt("up.stream", dns.TypeAAAA)
+		if err != nil {
+			t.Errorf("Failed to get record - %v", err)
+			continue
+		}
+		if r.Rcode != code {
+			t.Errorf("Expected the last reply (%s), got %s", dns.RcodeToString[code], dns.RcodeToString[r.Rcode])
+		}
+	}
+
+	// an unknown policy keeps the server from starting
+	server.Configure(func() { config.FallBackPolicy = "random" })
+	err := server.Start()
+	server.Configure(func() { config.FallBackPolicy = "sequential" })
+	if err == nil || !strings.Contains(err.Error(), "fallback-policy") {
+		t.Errorf("Expected a bad policy error, got %v", err)
+	}
+
+	// nothing to fall back on
+	server.Configure(func() { config.DnsFallBack = "127.0.0.1:8055@100ms" })
+	server.FlushCache()
+	r, err := ResolveIt("up.stream", dns.TypeAAAA)
+	if err != nil {
+		t.Errorf("Failed to get record - %v", err)
+		t.FailNow()
+	}
+	if r.Rcode != dns.RcodeServerFailure {
+		t.Errorf("Expected SERVFAIL with no live upstreams, got %v", dns.RcodeToString[r.Rcode])
+	}
+}
+
+func TestCache(t *testing.T) {
+	upstream := startUpstream(t, "127.0.0.1:8054")
+	defer upstream.Shutdown()
+
+	server.Configure(func() { config.DnsFallBack = "127.0.0.1:8054" })
+	defer server.Configure(func() { config.DnsFallBack = "" })
+	server.FlushCache()
+
+	for _, domain := range []string{"up.stream", "missing.stream"} {
+		before := atomic.LoadInt64(&upstreamQueries)
+		for i := 0; i < 3; i++ {
+			if _, err := ResolveIt(domain, dns.TypeAAAA); err != nil {
+				t.Errorf("Failed to get record - %v", err)
+			}
+		}
+		if n := atomic.LoadInt64(&upstreamQueries) - before; n != 1 {
+			t.Errorf("%s: expected 1 upstream query, got %d", domain, n)
+		}
+	}
+
+	stats := server.GetCacheStats()
+	if stats.Size != 2 || stats.Hits < 4 {
+		t.Errorf("Unexpected cache stats - %+v", stats)
+	}
+
+	// responses for one client subnet aren't given to another
+	before := atomic.LoadInt64(&upstreamQueries)
+	for _, subnet := range []string{"10.0.0.0", "10.1.0.0", "10.0.0.0"} {
+		m := new(dns.Msg)
+		m.SetQuestion("up.stream.", dns.TypeAAAA)
+		m.SetEdns0(4096, false)
+		m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 16, Address: net.ParseIP(subnet).To4()})
+		if _, err := dns.Exchange(m, config.DnsListen); err != nil {
+			t.Errorf("Failed to get record - %v", err)
+		}
+	}
+	if n := atomic.LoadInt64(&upstreamQueries) - before; n != 2 {
+		t.Errorf("Expected 2 upstream queries for 2 client subnets, got %d", n)
+	}
+
+	// cached responses echo the question as it was asked
+	before = atomic.LoadInt64(&upstreamQueries)
+	for _, name := range []string{"up.stream.", "Up.sTrEaM."} {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeAAAA)
+		r, err := dns.Exchange(m, config.DnsListen)
+		if err != nil {
+			t.Errorf("Failed to get record - %v", err)
+			continue
+		}
+		if len(r.Question) != 1 || r.Question[0].Name != name {
+			t.Errorf("Expected question '%s' echoed, got %v", name, r.Question)
+		}
+	}
+	if n := atomic.LoadInt64(&upstreamQueries) - before; n != 0 {
+		t.Errorf("Expected both cases answered from the cache, got %d upstream queries", n)
+	}
+
+	// flushed responses are fetched again
+	server.FlushCache()
+	before = atomic.LoadInt64(&upstreamQueries)
+	ResolveIt("up.stream", dns.TypeAAAA)
+	if n := atomic.LoadInt64(&upstreamQueries) - before; n != 1 {
+		t.Errorf("Expected 1 upstream query after flush, got %d", n)
+	}
+
+	// lru eviction
+	server.Configure(func() { config.FallBackCacheSize = 1 })
+	defer server.Configure(func() { config.FallBackCacheSize = 10000 })
+	ResolveIt("missing.stream", dns.TypeAAAA)
+	if stats := server.GetCacheStats(); stats.Size != 1 || stats.Evictions == 0 {
+		t.Errorf("Cache not bounded - %+v", stats)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	shaman.AddRecord(&nanopack)
+
+	m := new(dns.Msg)
+	m.SetQuestion("nanopack.io.", dns.TypeA)
+	c := &dns.Client{Net: "tcp-tls", TLSConfig: &tls.Config{InsecureSkipVerify: true}}
+	r, _, err := c.Exchange(m, config.DnsTlsListen)
+	if err != nil {
+		t.Errorf("Failed to exchange over tls - %v", err)
+		t.FailNow()
+	}
+	if len(r.Answer) != 1 || r.Answer[0].String() != "nanopack.io.\t60\tIN\tA\t127.0.0.1" {
+		t.Errorf("Response doesn't match expected - %v", r.Answer)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	big := sham.Resource{Domain: "big.nanopack.io."}
+	for i := 1; i <= 100; i++ {
+		big.Records = append(big.Records, sham.Record{Address: fmt.Sprintf("127.0.1.%d", i)})
+	}
+	err := shaman.AddRecord(&big)
+	if err != nil {
+		t.Errorf("Failed to add record - %v", err)
+		t.FailNow()
+	}
+
+	// udp answer shouldn't fit in 512 bytes
+	r, err := ResolveIt("big.nanopack.io", dns.TypeA)
+	if err != nil {
+		t.Errorf("Failed to get record - %v", err)
+		t.FailNow()
+	}
+	if !r.Truncated {
+		t.Error("Oversized udp response not truncated")
+	}
+	if r.Len() > dns.MinMsgSize {
+		t.Errorf("Truncated response too large - %d", r.Len())
+	}
+
+	// tcp gets it all
+	m := new(dns.Msg)
+	m.SetQuestion("big.nanopack.io.", dns.TypeA)
+	c := &dns.Client{Net: "tcp"}
+	r, _, err = c.Exchange(m, config.DnsListen)
+	if err != nil {
+		t.Errorf("Failed to exchange over tcp - %v", err)
+		t.FailNow()
+	}
+	if r.Truncated || len(r.Answer) != 100 {
+		t.Errorf("Expected 100 answers over tcp, got %d (truncated: %v)", len(r.Answer), r.Truncated)
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	server.Configure(func() { config.Domain = "xfr.test" })
+	defer server.Configure(func() {
+		config.Domain = "."
+		config.TransferAllow = ""
+		config.TransferKeys = ""
+	})
+
+	axfr := new(dns.Msg)
+	axfr.SetAxfr("xfr.test.")
+	transfer := func(m *dns.Msg) ([]dns.RR, error) {
+		env, err := (&dns.Transfer{}).In(m, config.DnsListen)
+		if err != nil {
+			return nil, err
+		}
+		records := make([]dns.RR, 0)
+		for e := range env {
+			if e.Error != nil {
+				return nil, e.Error
+			}
+			records = append(records, e.RR...)
+		}
+		return records, nil
+	}
+
+	// not on the allow-list
+	if _, err := transfer(axfr); err == nil {
+		t.Error("Transfer allowed to unlisted client")
+	}
+
+	// signed with a permitted key
+	server.Configure(func() { config.TransferKeys = "xfr.key" })
+	signed := axfr.Copy()
+	signed.SetTsig("xfr.key.", dns.HmacSHA512, 300, time.Now().Unix())
+	env, err := (&dns.Transfer{TsigSecret: map[string]string{"xfr.key.": "c2VjcmV0"}}).In(signed, config.DnsListen)
+	if err != nil {
+		t.Errorf("Failed to transfer zone - %v", err)
+		t.FailNow()
+	}
+	for e := range env {
+		if e.Error != nil {
+			t.Errorf("Failed signed transfer - %v", e.Error)
+		}
+	}
+	server.Configure(func() { config.TransferKeys = "" })
+
+	server.Configure(func() { config.TransferAllow = "10.0.0.1, 127.0.0.0/8" })
+	a := sham.Resource{Domain: "a.xfr.test.", Records: []sham.Record{{Address: "127.0.0.1"}}}
+	err = shaman.AddRecord(&a)
+	if err != nil {
+		t.Errorf("Failed to add record - %v", err)
+		t.FailNow()
+	}
+
+	records, err := transfer(axfr)
+	if err != nil {
+		t.Errorf("Failed to transfer zone - %v", err)
+		t.FailNow()
+	}
+	// SOA, NS, A, SOA
+	if len(records) != 4 || records[0].Header().Rrtype != dns.TypeSOA || records[3].Header().Rrtype != dns.TypeSOA ||
+		records[2].Header().Name != "a.xfr.test." {
+		t.Errorf("Bad zone transfer - %v", records)
+	}
+
+	// only the changes since the secondary's serial
+	serial := shaman.Serial()
+	b := sham.Resource{Domain: "b.xfr.test.", Records: []sham.Record{{Address: "127.0.0.2"}}}
+	err = shaman.AddRecord(&b)
+	if err != nil {
+		t.Errorf("Failed to add record - %v", err)
+		t.FailNow()
+	}
+
+	ixfr := new(dns.Msg)
+	ixfr.SetIxfr("xfr.test.", serial, "ns1.xfr.test.", "hostmaster.xfr.test.")
+	records, err = transfer(ixfr)
+	if err != nil {
+		t.Errorf("Failed to transfer zone - %v", err)
+		t.FailNow()
+	}
+	// SOA(new), SOA(old), SOA(new), A, SOA(new)
+	if len(records) != 5 || records[1].(*dns.SOA).Serial != serial || records[2].(*dns.SOA).Serial != serial+1 ||
+		records[3].Header().Name != "b.xfr.test." {
+		t.Errorf("Bad incremental zone transfer - %v", records)
+	}
+
+	// already current
+	ixfr.SetIxfr("xfr.test.", shaman.Serial(), "ns1.xfr.test.", "hostmaster.xfr.test.")
+	r, err := dns.Exchange(ixfr, config.DnsListen)
+	if err != nil {
+		t.Errorf("Failed to transfer zone - %v", err)
+		t.FailNow()
+	}
+	if len(r.Answer) != 1 || r.Answer[0].(*dns.SOA).Serial != shaman.Serial() {
+		t.Errorf("Expected lone SOA for current secondary - %v", r.Answer)
+	}
+
+	// no full transfers over udp
+	r, err = dns.Exchange(axfr, config.DnsListen)
+	if err != nil {
+		t.Errorf("Failed to transfer zone - %v", err)
+		t.FailNow()
+	}
+	if r.Rcode != dns.RcodeFormatError {
+		t.Errorf("Expected FORMERR for udp AXFR, got %v", dns.RcodeToString[r.Rcode])
+	}
+
+	shaman.DeleteRecord("a.xfr.test.")
+	shaman.DeleteRecord("b.xfr.test.")
+}
+
+func TestNotify(t *testing.T) {
+	// a secondary that only acknowledges the second NOTIFY
+	var notifies int64
+	acked := make(chan uint32, 1)
+	handler := func(res dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if req.Opcode != dns.OpcodeNotify || atomic.AddInt64(&notifies, 1) == 1 {
+			m.Rcode = dns.RcodeServerFailure
+		} else if soa, ok := req.Answer[0].(*dns.SOA); ok {
+			acked <- soa.Serial
+		}
+		res.WriteMsg(m)
+	}
+	started := make(chan struct{})
+	secondary := &dns.Server{Addr: "127.0.0.1:8056", Net: "udp", Handler: dns.HandlerFunc(handler), NotifyStartedFunc: func() { close(started) }}
+	go secondary.ListenAndServe()
+	<-started
+	defer secondary.Shutdown()
+
+	server.Configure(func() {
+		config.Domain = "notify.test"
+		config.Notify = "127.0.0.1:8056"
+	})
+	defer server.Configure(func() {
+		config.Domain = "."
+		config.Notify = ""
+	})
+
+	r := sham.Resource{Domain: "a.notify.test.", Records: []sham.Record{{Address: "127.0.0.1"}}}
+	err := shaman.AddRecord(&r)
+	if err != nil {
+		t.Errorf("Failed to add record - %v", err)
+		t.FailNow()
+	}
+	serial := shaman.Serial()
+
+	select {
+	case got := <-acked:
+		if got != serial {
+			t.Errorf("Expected NOTIFY for serial %d, got %d", serial, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("NOTIFY wasn't retried")
+	}
+
+	shaman.DeleteRecord("a.notify.test.")
+}
+
+func TestUpdate(t *testing.T) {
+	server.Configure(func() {
+		config.Domain = "update.test"
+		config.UpdateKeys = "update.key"
+	})
+	defer server.Configure(func() {
+		config.Domain = "."
+		config.UpdateKeys = ""
+	})
+
+	client := &dns.Client{TsigSecret: map[string]string{"update.key.": "c2VjcmV0", "other.key.": "c2VjcmV0", "Other.Key.": "c2VjcmV0", "bad.key.": "c2VjcmV0"}}
+	send := func(key string, build func(m *dns.Msg)) int {
+		m := new(dns.Msg)
+		m.SetUpdate("update.test.")
+		build(m)
+		if key != "" {
+			m.SetTsig(key, dns.HmacSHA256, 300, time.Now().Unix())
+		}
+		r, _, err := client.Exchange(m, config.DnsListen)
+		if err != nil {
+			t.Errorf("Failed to send update - %v", err)
+			return -1
+		}
+		if key == "update.key." && r.IsTsig() == nil {
+			t.Error("Response to signed update wasn't signed")
+		}
+		return r.Rcode
+	}
+	rr := func(s string) []dns.RR {
+		r, _ := dns.NewRR(s)
+		return []dns.RR{r}
+	}
+
+	tests := []struct {
+		key   string
+		build func(m *dns.Msg)
+		rcode int
+	}{
+		// unsigned, signed with an unknown key, or with one that may not update
+		{"", func(m *dns.Msg) { m.Insert(rr("a.update.test. 60 IN A 127.0.0.1")) }, dns.RcodeRefused},
+		{"bad.key.", func(m *dns.Msg) { m.Insert(rr("a.update.test. 60 IN A 127.0.0.1")) }, dns.RcodeNotAuth},
+		{"other.key.", func(m *dns.Msg) { m.Insert(rr("a.update.test. 60 IN A 127.0.0.1")) }, dns.RcodeRefused},
+		// key names are matched whatever their case
+		{"Other.Key.", func(m *dns.Msg) { m.Insert(rr("a.update.test. 60 IN A 127.0.0.1")) }, dns.RcodeRefused},
+		// outside of the zone
+		{"update.key.", func(m *dns.Msg) { m.Insert(rr("a.nanopack.io. 60 IN A 127.0.0.1")) }, dns.RcodeNotZone},
+		{"update.key.", func(m *dns.Msg) { m.Insert(rr("a.update.test. 60 IN A 127.0.0.1")) }, dns.RcodeSuccess},
+		{"update.key.", func(m *dns.Msg) { m.Insert(rr("a.update.test. 60 IN A 127.0.0.2")) }, dns.RcodeSuccess},
+		// prerequisites
+		{"update.key.", func(m *dns.Msg) { m.RRsetUsed(rr("b.update.test. 0 IN A 0.0.0.0")) }, dns.RcodeNXRrset},
+		{"update.key.", func(m *dns.Msg) { m.NameNotUsed(rr("a.update.test. 0 IN A 0.0.0.0")) }, dns.RcodeYXDomain},
+		{"update.key.", func(m *dns.Msg) {
+			m.Used(rr("a.update.test. 0 IN A 127.0.0.1"))
+			m.Remove(rr("a.update.test. 0 IN A 127.0.0.1"))
+		}, dns.RcodeNXRrset}, // not the whole rrset
+		{"update.key.", func(m *dns.Msg) {
+			m.Used(append(rr("a.update.test. 0 IN A 127.0.0.1"), rr("a.update.test. 0 IN A 127.0.0.2")...))
+			m.Remove(rr("a.update.test. 0 IN A 127.0.0.1"))
+		}, dns.RcodeSuccess},
+	}
+
+	for i, tt := range tests {
+		if rcode := send(tt.key, tt.build); rcode != tt.rcode {
+			t.Errorf("Update %d: expected %v, got %v", i, dns.RcodeToString[tt.rcode], dns.RcodeToString[rcode])
+		}
+	}
+
+	r, err := ResolveIt("a.update.test", dns.TypeA)
+	if err != nil {
+		t.Errorf("Failed to get record - %v", err)
+		t.FailNow()
+	}
+	if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "127.0.0.2" {
+		t.Errorf("Expected only the remaining record - %v", r.Answer)
+	}
+
+	// removing the last rrset removes the domain
+	send("update.key.", func(m *dns.Msg) { m.RemoveRRset(rr("a.update.test. 0 IN A 0.0.0.0")) })
+	if shaman.Exists("a.update.test.") {
+		t.Error("Domain wasn't removed with its last record")
+	}
+
+	// an update's changes are made together
+	serial := shaman.Serial()
+	send("update.key.", func(m *dns.Msg) {
+		m.Insert(append(rr("b.update.test. 60 IN A 127.0.0.1"), rr("c.update.test. 60 IN A 127.0.0.1")...))
+	})
+	if !shaman.Exists("b.update.test.") || !shaman.Exists("c.update.test.") || shaman.Serial() != serial+1 {
+		t.Errorf("Expected both domains added in one change, serial %d to %d", serial, shaman.Serial())
+	}
+	send("update.key.", func(m *dns.Msg) {
+		m.RemoveName(append(rr("b.update.test. 0 IN A 0.0.0.0"), rr("c.update.test. 0 IN A 0.0.0.0")...))
+	})
+
+	// deleting everything at the apex keeps its name servers
+	send("update.key.", func(m *dns.Msg) {
+		m.Insert(append(rr("update.test. 60 IN NS ns1.update.test."), rr("update.test. 60 IN A 127.0.0.1")...))
+	})
+	send("update.key.", func(m *dns.Msg) { m.RemoveName(rr("update.test. 0 IN A 0.0.0.0")) })
+	send("update.key.", func(m *dns.Msg) { m.Remove(rr("update.test. 0 IN NS ns1.update.test.")) })
+	resource, err := shaman.GetRecord("update.test.")
+	if err != nil || len(resource.Records) != 1 || resource.Records[0].RType != "NS" {
+		t.Errorf("Expected only the apex name server left - %+v %v", resource, err)
+	}
+	shaman.DeleteRecord("update.test.")
+}
+
+func TestDNSSEC(t *testing.T) {
+	server.Configure(func() {
+		config.Domain = "sec.test"
+		config.Dnssec = true
+	})
+	defer server.Configure(func() {
+		config.Domain = "."
+		config.Dnssec = false
+		config.DnssecDenial = "nsec"
+	})
+
+	a := sham.Resource{Domain: "a.sec.test.", Records: []sham.Record{{Address: "127.0.0.1"}}}
+	err := shaman.AddRecord(&a)
+	if err != nil {
+		t.Errorf("Failed to add record - %v", err)
+		t.FailNow()
+	}
+	defer shaman.DeleteRecord("a.sec.test.")
+
+	query := func(name string, rtype uint16, do bool) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, rtype)
+		m.SetEdns0(4096, do)
+		r, err := dns.Exchange(m, config.DnsListen)
+		if err != nil {
+			t.Errorf("Failed to get record - %v", err)
+			t.FailNow()
+		}
+		return r
+	}
+
+	// the keys sign themselves, and everything else
+	r := query("sec.test.", dns.TypeDNSKEY, true)
+	keys := map[uint16]*dns.DNSKEY{}
+	for _, rr := range r.Answer {
+		if key, ok := rr.(*dns.DNSKEY); ok {
+			keys[key.KeyTag()] = key
+		}
+	}
+	if len(keys) != 2 {
+		t.Errorf("Expected a KSK and ZSK - %v", r.Answer)
+		t.FailNow()
+	}
+	verify := func(r *dns.Msg, section []dns.RR) int {
+		verified := 0
+		for _, rr := range section {
+			sig, ok := rr.(*dns.RRSIG)
+			if !ok {
+				continue
+			}
+			rrset := make([]dns.RR, 0)
+			for _, x := range section {
+				if x.Header().Name == sig.Header().Name && x.Header().Rrtype == sig.TypeCovered {
+					rrset = append(rrset, x)
+				}
+			}
+			key, ok := keys[sig.KeyTag]
+			if !ok {
+				t.Errorf("Signed with unknown key %d", sig.KeyTag)
+			} else if err := sig.Verify(key, rrset); err != nil || !sig.ValidityPeriod(time.Now()) {
+				t.Errorf("Bad signature over %s - %v", sig.Header().Name, err)
+			} else {
+				verified++
+			}
+		}
+		return verified
+	}
+	if verify(r, r.Answer) != 1 {
+		t.Errorf("Expected signed DNSKEYs - %v", r.Answer)
+	}
+
+	r = query("a.sec.test.", dns.TypeA, true)
+	if len(r.Answer) != 2 || verify(r, r.Answer) != 1 {
+		t.Errorf("Expected signed answer - %v", r.Answer)
+	}
+	if opt := r.IsEdns0(); opt == nil || !opt.Do() {
+		t.Error("Expected DO bit in response")
+	}
+
+	// only for those that ask
+	r = query("a.sec.test.", dns.TypeA, false)
+	if len(r.Answer) != 1 {
+		t.Errorf("Expected unsigned answer - %v", r.Answer)
+	}
+
+	// authenticated denial
+	r = query("b.sec.test.", dns.TypeA, true)
+	nsecs := 0
+	for _, rr := range r.Ns {
+		if n, ok := rr.(*dns.NSEC); ok {
+			nsecs++
+			if n.Header().Name == "b.sec.test." {
+				t.Errorf("NSEC shouldn't match a name that doesn't exist - %v", n)
+			}
+		}
+	}
+	if r.Rcode != dns.RcodeNameError || nsecs != 2 || verify(r, r.Ns) != 3 {
+		t.Errorf("Expected signed NXDOMAIN with 2 NSECs - %v", r.Ns)
+	}
+
+	r = query("a.sec.test.", dns.TypeTXT, true)
+	if len(r.Ns) != 4 || verify(r, r.Ns) != 2 {
+		t.Errorf("Expected signed NODATA with an NSEC - %v", r.Ns)
+	} else if n, ok := r.Ns[2].(*dns.NSEC); !ok || n.Header().Name != "a.sec.test." || len(n.TypeBitMap) != 3 {
+		t.Errorf("Expected NSEC for a.sec.test. with A, NSEC and RRSIG - %v", r.Ns[2])
+	}
+
+	server.Configure(func() { config.DnssecDenial = "nsec3" })
+	r = query("b.c.sec.test.", dns.TypeA, true)
+	covered, matched := false, false
+	for _, rr := range r.Ns {
+		if n, ok := rr.(*dns.NSEC3); ok {
+			covered = covered || n.Cover("c.sec.test.")
+			matched = matched || n.Match("sec.test.")
+		}
+	}
+	if r.Rcode != dns.RcodeNameError || !covered || !matched || verify(r, r.Ns) != 4 {
+		t.Errorf("Expected NSEC3s matching the closest encloser and covering the next closer - %v", r.Ns)
+	}
+}
+
+func TestEdns(t *testing.T) {
+	err := shaman.AddRecord(&nanopack)
+	if err != nil {
+		t.Errorf("Failed to add record - %v", err)
+		t.FailNow()
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("nanopack.io.", dns.TypeA)
+	m.SetEdns0(4096, false)
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option,
+		&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102030405060708"},
+		&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("10.1.2.0").To4()})
+
+	r, err := dns.Exchange(m, config.DnsListen)
+	if err != nil {
+		t.Errorf("Failed to get record - %v", err)
+		t.FailNow()
+	}
+	opt = r.IsEdns0()
+	if opt == nil {
+		t.Error("Expected OPT record in response")
+		t.FailNow()
+	}
+	if int(opt.UDPSize()) != config.EdnsUdpSize {
+		t.Errorf("Expected advertised udp size %d, got %d", config.EdnsUdpSize, opt.UDPSize())
+	}
+	var cookie, subnet bool
+	for _, option := range opt.Option {
+		switch o := option.(type) {
+		case *dns.EDNS0_COOKIE:
+			// client cookie, then ours
+			cookie = len(o.Cookie) == 32 && o.Cookie[:16] == "0102030405060708"
+		case *dns.EDNS0_SUBNET:
+			subnet = o.SourceNetmask == 24 && o.SourceScope == 0 && o.Address.Equal(net.ParseIP("10.1.2.0"))
+		}
+	}
+	if !cookie || !subnet {
+		t.Errorf("Expected cookie and client subnet echoed - %v", opt.Option)
+	}
+
+	// unknown versions are refused
+	m = new(dns.Msg)
+	m.SetQuestion("nanopack.io.", dns.TypeA)
+	m.SetEdns0(4096, false)
+	m.IsEdns0().SetVersion(1)
+	r, err = dns.Exchange(m, config.DnsListen)
+	if err != nil {
+		t.Errorf("Failed to get record - %v", err)
+		t.FailNow()
+	}
+	// the upper bits of the rcode are in the OPT record
+	rcode := r.Rcode & 0xF
+	if opt := r.IsEdns0(); opt != nil {
+		rcode |= int(opt.Hdr.Ttl>>24) << 4
+	}
+	if rcode != dns.RcodeBadVers {
+		t.Errorf("Expected BADVERS, got %v", dns.RcodeToString[rcode])
+	}
+
+	shaman.DeleteRecord("nanopack.io.")
+}
+
+func TestGeo(t *testing.T) {
+	geo := sham.Resource{Domain: "geo.test.", Records: []sham.Record{
+		{Address: "10.0.0.1", Subnets: []string{"10.1.0.0/16"}},
+		{Address: "10.0.0.2", Subnets: []string{"eu"}},
+		{Address: "10.0.0.3"},
+		{Address: "10.0.0.4", Subnets: []string{"10.0.0.0/8"}},
+	}}
+	err := shaman.AddRecord(&geo)
+	if err != nil {
+		t.Errorf("Failed to add record - %v", err)
+		t.FailNow()
+	}
+
+	tests := []struct {
+		subnet  string
+		address string
+	}{
+		{"10.1.2.0", "10.0.0.1"},  // most specific network wins
+		{"10.2.3.0", "10.0.0.2"},  // by region
+		{"10.9.0.0", "10.0.0.4"},  // by the wider network
+		{"192.0.2.0", "10.0.0.3"}, // untagged for everyone else
+		{"", "10.0.0.3"},          // the client's own address
+	}
+	for _, tt := range tests {
+		m := new(dns.Msg)
+		m.SetQuestion("geo.test.", dns.TypeA)
+		m.SetEdns0(4096, false)
+		if tt.subnet != "" {
+			opt := m.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP(tt.subnet).To4()})
+		}
+		r, err := dns.Exchange(m, config.DnsListen)
+		if err != nil {
+			t.Errorf("Failed to get record - %v", err)
+			continue
+		}
+		if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != tt.address {
+			t.Errorf("Expected %s for %s, got %v", tt.address, tt.subnet, r.Answer)
+		}
+		for _, option := range r.IsEdns0().Option {
+			if o, ok := option.(*dns.EDNS0_SUBNET); ok && o.SourceScope != 24 {
+				t.Errorf("Expected scope 24 for %s, got %d", tt.subnet, o.SourceScope)
+			}
+		}
+	}
+
+	shaman.DeleteRecord("geo.test.")
+}
+
+func TestPolicy(t *testing.T) {
+	policy := sham.Resource{Domain: "policy.test.", Records: []sham.Record{
+		{Address: "10.0.0.1", Weight: 1},
+		{Address: "10.0.0.2", Weight: 100},
+		{Address: "10.0.0.3", Weight: 1},
+		{RType: "TXT", Address: "\"policy\""},
+	}}
+
+	tests := []struct {
+		policy  string
+		answers int
+		count   int // records per answer
+	}{
+		{"", 0, 3},
+		{"shuffle", 0, 3},
+		{"weighted", 0, 1},
+		{"top", 2, 2},
+	}
+	for _, tt := range tests {
+		policy.Policy, policy.Answers = tt.policy, tt.answers
+		shaman.DeleteRecord("policy.test.")
+		err := shaman.AddRecord(&policy)
+		if err != nil {
+			t.Errorf("Failed to add record - %v", err)
+			t.FailNow()
+		}
+
+		firsts := make(map[string]int)
+		for i := 0; i < 50; i++ {
+			r, err := ResolveIt("policy.test", dns.TypeA)
+			if err != nil || len(r.Answer) != tt.count {
+				t.Errorf("Expected %d records with policy '%s' - %v %v", tt.count, tt.policy, r, err)
+				t.FailNow()
+			}
+			firsts[r.Answer[0].(*dns.A).A.String()]++
+		}
+
+		switch tt.policy {
+		case "":
+			// stored order
+			if firsts["10.0.0.1"] != 50 {
+				t.Errorf("Expected records in stored order - %v", firsts)
+			}
+		default:
+			// mostly the heaviest
+			if firsts["10.0.0.2"] < 40 {
+				t.Errorf("Expected heaviest record first with policy '%s' - %v", tt.policy, firsts)
+			}
+		}
+
+		// other types are answered as they are
+		r, err := ResolveIt("policy.test", dns.TypeTXT)
+		if err != nil || len(r.Answer) != 1 {
+			t.Errorf("Expected TXT record with policy '%s' - %v %v", tt.policy, r, err)
+		}
+	}
+
+	shaman.DeleteRecord("policy.test.")
+}
+
+func TestHealth(t *testing.T) {
+	up, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("Failed to listen - %v", err)
+		t.FailNow()
+	}
+	defer up.Close()
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("Failed to listen - %v", err)
+		t.FailNow()
+	}
+	down.Close()
+
+	check := func(target string) *sham.Check {
+		return &sham.Check{Type: "tcp", Target: target, Interval: 1, Timeout: 1, Rise: 1, Fall: 1}
+	}
+	health := sham.Resource{Domain: "health.test.", Records: []sham.Record{
+		{Address: "10.0.0.1", Check: check(up.Addr().String())},
+		{Address: "10.0.0.2", Check: check(down.Addr().String())},
+	}}
+	err = shaman.AddRecord(&health)
+	if err != nil {
+		t.Errorf("Failed to add record - %v", err)
+		t.FailNow()
+	}
+	<-time.After(500 * time.Millisecond)
+
+	r, err := ResolveIt("health.test", dns.TypeA)
+	if err != nil || len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "10.0.0.1" {
+		t.Errorf("Expected only the healthy record - %v %v", r, err)
+	}
+	statuses := server.GetHealth()
+	if len(statuses) != 2 || !statuses[0].Healthy || statuses[1].Healthy || statuses[1].Error == "" {
+		t.Errorf("Expected one healthy and one failing record - %+v", statuses)
+	}
+
+	// with every record down, they're all answered with
+	up.Close()
+	<-time.After(1500 * time.Millisecond)
+	r, err = ResolveIt("health.test", dns.TypeA)
+	if err != nil || len(r.Answer) != 2 {
+		t.Errorf("Expected every record when all are down - %v %v", r, err)
+	}
+
+	shaman.DeleteRecord("health.test.")
+	<-time.After(100 * time.Millisecond)
+	if statuses := server.GetHealth(); len(statuses) != 0 {
+		t.Errorf("Expected checks to stop with the record - %+v", statuses)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	err := shaman.AddRecord(&nanopack)
+	if err != nil {
+		t.Errorf("Failed to add record - %v", err)
+		t.FailNow()
+	}
+
+	client := &dns.Client{Net: "udp", Timeout: 100 * time.Millisecond}
+	query := func() (*dns.Msg, error) {
+		m := new(dns.Msg)
+		m.SetQuestion("nanopack.io.", dns.TypeA)
+		r, _, err := client.Exchange(m, config.DnsListen)
+		return r, err
+	}
+
+	// queries over the limit are dropped
+	server.Configure(func() { config.RateLimit = 5 })
+	before := server.GetRateLimitStats()
+	answered := 0
+	for i := 0; i < 10; i++ {
+		if _, err := query(); err == nil {
+			answered++
+		}
+	}
+	server.Configure(func() { config.RateLimit = 0 })
+	if answered < 5 || answered > 6 {
+		t.Errorf("Expected about 5 of 10 queries answered, got %d", answered)
+	}
+	if limited := server.GetRateLimitStats().Limited - before.Limited; limited != uint64(10-answered) {
+		t.Errorf("Expected %d queries counted as limited, got %d", 10-answered, limited)
+	}
+
+	// identical responses over the limit are dropped, or every other one slipped
+	server.Configure(func() { config.RrlResponses, config.RrlSlip = 2, 2 })
+	before = server.GetRateLimitStats()
+	answered, slipped, dropped := 0, 0, 0
+	for i := 0; i < 6; i++ {
+		r, err := query()
+		switch {
+		case r != nil && r.Truncated && len(r.Answer) == 0:
+			// (older clients also return an error for truncated responses)
+			slipped++
+		case err != nil:
+			dropped++
+		default:
+			answered++
+		}
+	}
+	server.Configure(func() { config.RrlResponses = 0 })
+	if answered != 2 || slipped != 2 || dropped != 2 {
+		t.Errorf("Expected 2 answered, 2 slipped and 2 dropped, got %d, %d and %d", answered, slipped, dropped)
+	}
+	stats := server.GetRateLimitStats()
+	if stats.Slipped-before.Slipped != 2 || stats.Dropped-before.Dropped != 2 {
+		t.Errorf("Expected rrl counters to match - %+v", stats)
+	}
+
+	shaman.DeleteRecord("nanopack.io.")
+
+	// prefixes longer than an address keep the server from starting
+	for _, prefixes := range [][2]int{{33, 56}, {-1, 56}, {24, 129}} {
+		server.Configure(func() { config.RateLimitIpv4Prefix, config.RateLimitIpv6Prefix = prefixes[0], prefixes[1] })
+		if err := server.Start(); err == nil || !strings.Contains(err.Error(), "prefix") {
+			t.Errorf("Expected a bad prefix error for %v, got %v", prefixes, err)
+		}
+	}
+	server.Configure(func() { config.RateLimitIpv4Prefix, config.RateLimitIpv6Prefix = 24, 56 })
+}
+
+func TestViews(t *testing.T) {
+	resources := []sham.Resource{
+		{Domain: "view.test.", Records: []sham.Record{
+			{Address: "10.0.0.1", Views: []string{"internal"}},
+			{Address: "1.2.3.4", Views: []string{"external"}},
+			{Address: "5.6.7.8"},
+		}},
+		{Domain: "internal.test.", Views: []string{"internal"}, Records: []sham.Record{{Address: "10.0.0.2"}}},
+		{Domain: "a.hidden.test.", Views: []string{"internal"}, Records: []sham.Record{{Address: "10.0.0.3"}}},
+		{Domain: "*.scoped.test.", Records: []sham.Record{{Address: "9.9.9.9"}}},
+		{Domain: "a.scoped.test.", Views: []string{"internal"}, Records: []sham.Record{{Address: "10.0.0.4"}}},
+	}
+	for i := range resources {
+		err := shaman.AddRecord(&resources[i])
+		if err != nil {
+			t.Errorf("Failed to add record - %v", err)
+			t.FailNow()
+		}
+	}
+
+	client := &dns.Client{TsigSecret: map[string]string{"other.key.": "c2VjcmV0"}}
+	query := func(domain string, signed bool) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(domain, dns.TypeA)
+		if signed {
+			m.SetTsig("other.key.", dns.HmacSHA256, 300, time.Now().Unix())
+		}
+		r, _, err := client.Exchange(m, config.DnsListen)
+		if err != nil {
+			t.Errorf("Failed to get record - %v", err)
+			t.FailNow()
+		}
+		return r
+	}
+	addresses := func(r *dns.Msg) string {
+		found := make([]string, 0)
+		for _, rr := range r.Answer {
+			found = append(found, rr.(*dns.A).A.String())
+		}
+		return fmt.Sprint(found)
+	}
+
+	// signed queries are answered from the internal view, others (from
+	// 127.0.0.1) from the external one
+	tests := []struct {
+		signed bool
+		domain string
+		answer string
+		rcode  int
+	}{
+		{true, "view.test.", "[10.0.0.1 5.6.7.8]", dns.RcodeSuccess},
+		{false, "view.test.", "[1.2.3.4 5.6.7.8]", dns.RcodeSuccess},
+		{true, "internal.test.", "[10.0.0.2]", dns.RcodeSuccess},
+		{false, "internal.test.", "[]", dns.RcodeNameError},
+		// names only beneath a hidden one don't exist either
+		{true, "hidden.test.", "[]", dns.RcodeSuccess},
+		{false, "hidden.test.", "[]", dns.RcodeNameError},
+		// and hidden names don't stop wildcards from matching
+		{true, "a.scoped.test.", "[10.0.0.4]", dns.RcodeSuccess},
+		{false, "a.scoped.test.", "[9.9.9.9]", dns.RcodeSuccess},
+	}
+	for _, tt := range tests {
+		r := query(tt.domain, tt.signed)
+		if addresses(r) != tt.answer || r.Rcode != tt.rcode {
+			t.Errorf("Expected %s %s for '%s' (signed %v), got %s %s", dns.RcodeToString[tt.rcode], tt.answer,
+				tt.domain, tt.signed, dns.RcodeToString[r.Rcode], addresses(r))
+		}
+	}
+
+	views := server.GetViews()
+	if len(views) != 2 || views[0].Name != "internal" || !hasDomain(views[0].Domains, "internal.test.") ||
+		views[1].Name != "external" || hasDomain(views[1].Domains, "internal.test.") || !hasDomain(views[1].Domains, "view.test.") {
+		t.Errorf("Expected internal.test. in only the internal view - %+v", views)
+	}
+	for _, resource := range server.GetViewRecords("external") {
+		if resource.Domain == "view.test." && len(resource.Records) != 2 {
+			t.Errorf("Expected view.test. with 2 records in the external view - %+v", resource)
+		}
+	}
+
+	// clients in no view only see what isn't in any
+	for _, resource := range server.GetViewRecords("") {
+		if resource.Domain == "internal.test." || resource.Domain == "view.test." && len(resource.Records) != 1 {
+			t.Errorf("Expected only records without views - %+v", resource)
+		}
+	}
+
+	for i := range resources {
+		shaman.DeleteRecord(resources[i].Domain)
+	}
+
+	// malformed views, or ones keyed on unknown tsig keys, keep the server from starting
+	configured := config.Views
+	for _, bad := range []string{"internal=key:missing.key", "internal=10.0.0.0/33", "=any"} {
+		server.Configure(func() { config.Views = bad })
+		if err := server.Start(); err == nil || !strings.Contains(err.Error(), "Bad view") {
+			t.Errorf("Expected a bad view error for '%s', got %v", bad, err)
+		}
+	}
+	server.Configure(func() { config.Views = configured })
+}
+
+func TestQueryLog(t *testing.T) {
+	err := shaman.AddRecord(&nanopack)
+	if err != nil {
+		t.Errorf("Failed to add record - %v", err)
+		t.FailNow()
+	}
+
+	dir, err := ioutil.TempDir("", "shaman-querylog")
+	if err != nil {
+		t.Errorf("Failed to create temp dir - %v", err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	// a dnstap collector, handing back the frames it's sent
+	listener, err := net.Listen("unix", filepath.Join(dir, "dnstap.sock"))
+	if err != nil {
+		t.Errorf("Failed to listen for dnstap - %v", err)
+		t.FailNow()
+	}
+	defer listener.Close()
+	frames := make(chan []byte, 10)
+	go func() {
+		defer close(frames)
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			frame, control, err := readFrame(conn)
+			if err != nil {
+				return
+			}
+			switch {
+			case control == 4: // READY, ACCEPT it
+				conn.Write([]byte{0, 0, 0, 0, 0, 0, 0, 4, 0, 0, 0, 1})
+			case control == 3: // STOP, FINISH it
+				conn.Write([]byte{0, 0, 0, 0, 0, 0, 0, 4, 0, 0, 0, 5})
+				return
+			case control == 0:
+				frames <- frame
+			}
+		}
+	}()
+
+	sinks := []string{"file://" + filepath.Join(dir, "queries.log"), "dnstap://" + filepath.Join(dir, "dnstap.sock")}
+	server.Configure(func() { config.QueryLog = strings.Join(sinks, ", ") })
+	defer server.Configure(func() { config.QueryLog = "" })
+	err = server.SetQueryLog(true, sinks)
+	if err != nil {
+		t.Errorf("Failed to enable query log - %v", err)
+		t.FailNow()
+	}
+	if status := server.GetQueryLog(); !status.Enabled || len(status.Sinks) != 2 {
+		t.Errorf("Expected the query log to be enabled - %+v", status)
+	}
+
+	_, err = ResolveIt("nanopack.io", dns.TypeA)
+	if err != nil {
+		t.Errorf("Failed to get record - %v", err)
+	}
+
+	// disabling writes out what's left
+	err = server.SetQueryLog(false, nil)
+	if err != nil {
+		t.Errorf("Failed to disable query log - %v", err)
+	}
+	if status := server.GetQueryLog(); status.Enabled || status.Logged == 0 {
+		t.Errorf("Expected the query log to be disabled, having logged - %+v", status)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "queries.log"))
+	if err != nil {
+		t.Errorf("Failed to read query log - %v", err)
+		t.FailNow()
+	}
+	var record server.QueryRecord
+	err = json.Unmarshal(b, &record)
+	if err != nil {
+		t.Errorf("Failed to parse query log %q - %v", b, err)
+	}
+	if record.Name != "nanopack.io." || record.Type != "A" || record.Rcode != "NOERROR" || record.Answers != 1 ||
+		record.Source != "local" || record.Client != "127.0.0.1" || record.Protocol != "udp" {
+		t.Errorf("Logged query doesn't match expected - %+v", record)
+	}
+
+	// a CLIENT_QUERY and a CLIENT_RESPONSE, holding the question
+	types := make([]int, 0)
+	for frame := range frames {
+		types = append(types, dnstapType(frame))
+		if !bytes.Contains(frame, []byte("\x08nanopack\x02io\x00")) {
+			t.Errorf("Dnstap frame doesn't hold the question - %q", frame)
+		}
+	}
+	if fmt.Sprint(types) != "[5 6]" {
+		t.Errorf("Expected a dnstap CLIENT_QUERY and CLIENT_RESPONSE, got types %v", types)
+	}
+
+	// queries aren't logged once disabled, and sinks that aren't configured
+	// (or are bad) aren't enabled
+	_, err = ResolveIt("nanopack.io", dns.TypeA)
+	if err != nil {
+		t.Errorf("Failed to get record - %v", err)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, "queries.log")); bytes.Count(b, []byte("\n")) != 1 {
+		t.Errorf("Expected one logged query - %q", b)
+	}
+	if err = server.SetQueryLog(true, []string{"file://" + filepath.Join(dir, "elsewhere.log")}); err == nil {
+		t.Error("Expected a sink that isn't configured to fail")
+	}
+	server.Configure(func() { config.QueryLog = "syslog://" })
+	if err = server.SetQueryLog(true, []string{"syslog://"}); err == nil {
+		t.Error("Expected an unknown sink to fail")
+	}
+}
+
+func TestDnstap(t *testing.T) {
+	upstream := startUpstream(t, "127.0.0.1:8054")
+	defer upstream.Shutdown()
+	server.Configure(func() { config.DnsFallBack = "127.0.0.1:8054" })
+	defer server.Configure(func() { config.DnsFallBack = "" })
+	server.FlushCache()
+
+	err := shaman.AddRecord(&nanopack)
+	if err != nil {
+		t.Errorf("Failed to add record - %v", err)
+		t.FailNow()
+	}
+
+	dir, err := ioutil.TempDir("", "shaman-dnstap")
+	if err != nil {
+		t.Errorf("Failed to create temp dir - %v", err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	server.Configure(func() { config.QueryLog = "dnstap-file://" + filepath.Join(dir, "shaman.dnstap") })
+	defer server.Configure(func() { config.QueryLog = "" })
+	err = server.SetQueryLog(true, []string{config.QueryLog})
+	if err != nil {
+		t.Errorf("Failed to enable query log - %v", err)
+		t.FailNow()
+	}
+	ResolveIt("nanopack.io", dns.TypeA)
+	ResolveIt("tap.stream", dns.TypeA)
+	err = server.SetQueryLog(false, nil)
+	if err != nil {
+		t.Errorf("Failed to disable query log - %v", err)
+	}
+
+	// a unidirectional stream: START, the messages, then STOP
+	file, err := os.Open(filepath.Join(dir, "shaman.dnstap"))
+	if err != nil {
+		t.Errorf("Failed to open dnstap file - %v", err)
+		t.FailNow()
+	}
+	defer file.Close()
+	if _, control, err := readFrame(file); err != nil || control != 2 {
+		t.Errorf("Expected a START frame, got %d - %v", control, err)
+	}
+	types := make([]int, 0)
+	for {
+		frame, control, err := readFrame(file)
+		if err != nil || control != 0 {
+			if control != 3 {
+				t.Errorf("Expected a STOP frame, got %d - %v", control, err)
+			}
+			break
+		}
+		types = append(types, dnstapType(frame))
+	}
+
+	// the local answer, then the forwarded one with its trip to the fallback server
+	if fmt.Sprint(types) != "[5 6 5 7 8 6]" {
+		t.Errorf("Expected CLIENT_QUERY/RESPONSE, then with FORWARDER_QUERY/RESPONSE, got types %v", types)
+	}
+
+	// turned on again, the earlier stream is rotated rather than written over
+	earlier, _ := ioutil.ReadFile(filepath.Join(dir, "shaman.dnstap"))
+	if err = server.SetQueryLog(true, []string{config.QueryLog}); err != nil {
+		t.Errorf("Failed to enable query log - %v", err)
+		t.FailNow()
+	}
+	ResolveIt("nanopack.io", dns.TypeA)
+	server.SetQueryLog(false, nil)
+	if rotated, _ := ioutil.ReadFile(filepath.Join(dir, "shaman.dnstap.1")); string(rotated) != string(earlier) {
+		t.Errorf("Expected the earlier stream in shaman.dnstap.1 (%d bytes), got %d bytes", len(earlier), len(rotated))
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	upstream := startUpstream(t, "127.0.0.1:8054")
+	defer upstream.Shutdown()
+	server.Configure(func() { config.DnsFallBack = "127.0.0.1:8054" })
+	defer server.Configure(func() { config.DnsFallBack = "" })
+	server.FlushCache()
+
+	err := shaman.AddRecord(&nanopack)
+	if err != nil {
+		t.Errorf("Failed to add record - %v", err)
+		t.FailNow()
+	}
+
+	ResolveIt("nanopack.io", dns.TypeMX)
+	ResolveIt("metrics.stream", dns.TypeA)
+	ResolveIt("metrics.stream", dns.TypeA)
+
+	var out bytes.Buffer
+	metrics.Write(&out)
+	for _, expected := range []string{
+		`shaman_dns_queries_total{qtype="MX",rcode="NOERROR"}`,
+		`shaman_dns_queries_total{qtype="A",rcode="NXDOMAIN"}`,
+		`shaman_fallback_queries_total{result="cached"}`,
+		`shaman_fallback_queries_total{result="answered"}`,
+		`shaman_fallback_duration_seconds_count{server="127.0.0.1:8054",result="answered"}`,
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected %q in metrics - %q", expected, out.String())
+		}
+	}
+}
+
+// dnstapType returns the type of the message in a dnstap protobuf
+func dnstapType(b []byte) int {
+	varint := func() uint64 {
+		v, shift := uint64(0), uint(0)
+		for len(b) > 0 {
+			c := b[0]
+			b = b[1:]
+			v |= uint64(c&0x7f) << shift
+			if c < 0x80 {
+				break
+			}
+			shift += 7
+		}
+		return v
+	}
+	for len(b) > 0 {
+		tag := varint()
+		switch tag & 7 {
+		case 0:
+			v := varint()
+			if tag>>3 == 1 {
+				return int(v) // Message.type, once within the message
+			}
+		case 2:
+			n := int(varint())
+			if tag>>3 != 14 && n <= len(b) { // descend into Dnstap.message
+				b = b[n:]
+			}
+		case 5:
+			b = b[4:]
+		default:
+			return -1
+		}
+	}
+	return -1
+}
+
+// readFrame reads a frame streams frame, returning a data frame's data or a
+// control frame's type
+func readFrame(conn io.Reader) ([]byte, uint32, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, 0, err
+	}
+	control := binary.BigEndian.Uint32(header) == 0 // escaped
+	if control {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return nil, 0, err
+		}
+	}
+	frame := make([]byte, binary.BigEndian.Uint32(header))
+	if _, err := io.ReadFull(conn, frame); err != nil {
+		return nil, 0, err
+	}
+	if control && len(frame) >= 4 {
+		return nil, binary.BigEndian.Uint32(frame), nil
+	}
+	return frame, 0, nil
+}
+
+// hasDomain returns whether domains contains domain
+func hasDomain(domains []string, domain string) bool {
+	for i := range domains {
+		if domains[i] == domain {
+			return true
+		}
+	}
+	return false
+}
+
+func TestConcurrentLookups(t *testing.T) {
+	shaman.AddRecord(&nanopack)
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+
+	// hammer lookups while records change underneath
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				r, err := ResolveIt("nanopack.io", dns.TypeA)
+				if err != nil {
+					t.Errorf("Failed to get record - %v", err)
+					return
+				}
+				if len(r.Answer) == 0 {
+					t.Error("No record found")
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 200; i++ {
+		resource := sham.Resource{Domain: fmt.Sprintf("%d.nanobox.io.", i), Records: []sham.Record{{Address: "127.0.0.2"}}}
+		shaman.AddRecord(&resource)
+		shaman.UpdateRecord("nanopack.io", &nanopack)
+		shaman.DeleteRecord(resource.Domain)
+	}
+
+	close(done)
+	wg.Wait()
+}
+
 func ResolveIt(domain string, rType uint16, badop ...bool) (*dns.Msg, error) {
 	// root domain if not already
 	root(&domain)
@@ -102,6 +1757,44 @@ func ResolveIt(domain string, rType uint16, badop ...bool) (*dns.Msg, error) {
 	return r, nil
 }
 
+// upstreamQueries counts queries the fake upstream has answered
+var upstreamQueries int64
+
+// startUpstream starts a fake upstream resolver for the 'stream.' tld
+func startUpstream(t *testing.T, addr string) *dns.Server {
+	handler := func(res dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt64(&upstreamQueries, 1)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		q := req.Question[0]
+		switch q.Name {
+		case "up.stream.":
+			rr, _ := dns.NewRR("up.stream. 60 IN AAAA ::1")
+			m.Answer = append(m.Answer, rr)
+		case "do.stream.":
+			do := req.IsEdns0() != nil && req.IsEdns0().Do()
+			rr, _ := dns.NewRR(fmt.Sprintf("do.stream. 60 IN TXT \"do=%v\"", do))
+			m.Answer = append(m.Answer, rr)
+		default:
+			m.Rcode = dns.RcodeNameError
+			rr, _ := dns.NewRR("stream. 60 IN SOA ns.stream. admin.stream. 1 60 60 60 60")
+			m.Ns = append(m.Ns, rr)
+		}
+		res.WriteMsg(m)
+	}
+
+	started := make(chan struct{})
+	server := &dns.Server{Addr: addr, Net: "udp", Handler: dns.HandlerFunc(handler), NotifyStartedFunc: func() { close(started) }}
+	go func() {
+		if err := server.ListenAndServe(); err != nil {
+			t.Errorf("Failed to start upstream - %v", err)
+		}
+	}()
+	<-started
+
+	return server
+}
+
 func root(domain *string) {
 	t := []byte(*domain)
 	if len(t) > 0 && t[len(t)-1] != '.' {
@@ -0,0 +1,295 @@
+package server
+
+import (
+	"container/list"
+	"crypto"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/nanopack/shaman/config"
+)
+
+const (
+	// signatureValidity is how long signatures are valid for
+	signatureValidity = 7 * 24 * time.Hour
+	// signatureCacheSize is the most signatures kept for reuse
+	signatureCacheSize = 10000
+)
+
+var (
+	keys     *signingKeys
+	keysErr  error
+	keysOnce sync.Once
+
+	signatures = &signatureCache{entries: make(map[string]*list.Element), lru: list.New()}
+)
+
+// signingKey is a DNSKEY with its private half
+type signingKey struct {
+	key    *dns.DNSKEY
+	signer crypto.Signer
+}
+
+// signingKeys are the zone's key signing key (signs the DNSKEYs) and zone
+// signing key (signs everything else)
+type signingKeys struct {
+	ksk signingKey
+	zsk signingKey
+}
+
+// signatureCache holds on to signatures so rrsets aren't signed on every
+// query, dropping the least recently used once full
+type signatureCache struct {
+	sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type cachedSignature struct {
+	id  string
+	sig *dns.RRSIG
+}
+
+// get returns a copy of the signature cached for id, if it's valid past until
+func (self *signatureCache) get(id string, until time.Time) *dns.RRSIG {
+	self.Lock()
+	defer self.Unlock()
+	element, ok := self.entries[id]
+	if !ok {
+		return nil
+	}
+	sig := element.Value.(*cachedSignature).sig
+	if int64(sig.Expiration) <= until.Unix() {
+		return nil
+	}
+	self.lru.MoveToFront(element)
+	cp := *sig
+	return &cp
+}
+
+// set caches sig for id
+func (self *signatureCache) set(id string, sig *dns.RRSIG) {
+	self.Lock()
+	defer self.Unlock()
+	if element, ok := self.entries[id]; ok {
+		element.Value = &cachedSignature{id, sig}
+		self.lru.MoveToFront(element)
+		return
+	}
+	for self.lru.Len() >= signatureCacheSize {
+		oldest := self.lru.Back()
+		self.lru.Remove(oldest)
+		delete(self.entries, oldest.Value.(*cachedSignature).id)
+	}
+	self.entries[id] = self.lru.PushFront(&cachedSignature{id, sig})
+}
+
+// getKeys returns the signing keys, loading (or generating) them the first time
+func getKeys() (*signingKeys, error) {
+	keysOnce.Do(func() {
+		keys = &signingKeys{}
+		if keysErr = loadKey(&keys.ksk, "ksk", 257); keysErr != nil {
+			return
+		}
+		keysErr = loadKey(&keys.zsk, "zsk", 256)
+	})
+	return keys, keysErr
+}
+
+// loadKey reads the key pair `name.key`/`name.private` from config.DnssecKeyDir,
+// generating (and saving) it if it doesn't exist
+func loadKey(k *signingKey, name string, flags uint16) error {
+	public := filepath.Join(config.DnssecKeyDir, name+".key")
+	private := filepath.Join(config.DnssecKeyDir, name+".private")
+
+	if config.DnssecKeyDir != "" {
+		if _, err := os.Stat(public); err == nil {
+			return readKey(k, public, private)
+		}
+	}
+
+	k.key = &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := k.key.Generate(256)
+	if err != nil {
+		return fmt.Errorf("Failed to generate %s - %v", name, err)
+	}
+	k.signer = priv.(crypto.Signer)
+
+	if config.DnssecKeyDir == "" {
+		config.Log.Info("Generated %s (tag %d), it will change when shaman restarts", name, k.key.KeyTag())
+		return nil
+	}
+
+	k.key.Hdr.Name = zone()
+	err = ioutil.WriteFile(public, []byte(k.key.String()+"\n"), 0644)
+	if err == nil {
+		err = ioutil.WriteFile(private, []byte(k.key.PrivateKeyString(priv)), 0600)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to save %s - %v", name, err)
+	}
+	config.Log.Info("Generated %s (tag %d) in '%s'", name, k.key.KeyTag(), config.DnssecKeyDir)
+	return nil
+}
+
+// readKey reads a key pair written by loadKey (or dnssec-keygen)
+func readKey(k *signingKey, public, private string) error {
+	f, err := os.Open(public)
+	if err != nil {
+		return fmt.Errorf("Failed to open key - %v", err)
+	}
+	defer f.Close()
+	rr, err := dns.ReadRR(f, public)
+	if err != nil {
+		return fmt.Errorf("Failed to read key - %v", err)
+	}
+	key, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return fmt.Errorf("Failed to read key - '%s' isn't a DNSKEY", public)
+	}
+
+	p, err := os.Open(private)
+	if err != nil {
+		return fmt.Errorf("Failed to open private key - %v", err)
+	}
+	defer p.Close()
+	priv, err := key.ReadPrivateKey(p, private)
+	if err != nil {
+		return fmt.Errorf("Failed to read private key - %v", err)
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("Failed to read private key - unsupported algorithm")
+	}
+
+	k.key, k.signer = key, signer
+	config.Log.Debug("Loaded key '%s' (tag %d)", public, key.KeyTag())
+	return nil
+}
+
+// dnskeys returns the zone's DNSKEY records
+func dnskeys() []dns.RR {
+	k, err := getKeys()
+	if err != nil {
+		config.Log.Error("Failed to load dnssec keys - %v", err)
+		return nil
+	}
+
+	records := make([]dns.RR, 0, 2)
+	for _, key := range []*dns.DNSKEY{k.ksk.key, k.zsk.key} {
+		rr := *key
+		rr.Hdr.Name = zone()
+		records = append(records, &rr)
+	}
+	return records
+}
+
+// dsRecords returns the DS records to hand to the parent zone
+func dsRecords() []*dns.DS {
+	records := make([]*dns.DS, 0)
+	for _, rr := range dnskeys() {
+		if key := rr.(*dns.DNSKEY); key.Flags == 257 {
+			records = append(records, key.ToDS(dns.SHA256))
+		}
+	}
+	return records
+}
+
+// dnssecOk returns whether req wants (and should get) signed answers
+func dnssecOk(req *dns.Msg) bool {
+	opt := req.IsEdns0()
+	return config.Dnssec && opt != nil && opt.Do()
+}
+
+// signMessage adds signatures to every rrset in the answer and authority
+// sections that falls within the zone
+func signMessage(message *dns.Msg) {
+	message.Answer = signSection(message.Answer)
+	message.Ns = signSection(message.Ns)
+}
+
+// signSection returns section with each in-zone rrset followed by its RRSIG
+func signSection(section []dns.RR) []dns.RR {
+	type rrset struct {
+		name  string
+		rtype uint16
+	}
+	order := make([]rrset, 0)
+	sets := make(map[rrset][]dns.RR)
+	for _, rr := range section {
+		set := rrset{strings.ToLower(rr.Header().Name), rr.Header().Rrtype}
+		if _, ok := sets[set]; !ok {
+			order = append(order, set)
+		}
+		sets[set] = append(sets[set], rr)
+	}
+
+	signed := make([]dns.RR, 0, len(section)*2)
+	for _, set := range order {
+		signed = append(signed, sets[set]...)
+		if set.rtype == dns.TypeRRSIG || set.rtype == dns.TypeOPT || !inZone(set.name) {
+			continue
+		}
+		sig, err := signRRset(sets[set])
+		if err != nil {
+			config.Log.Error("Failed to sign '%s' %s - %v", set.name, dns.TypeToString[set.rtype], err)
+			continue
+		}
+		signed = append(signed, sig)
+	}
+	return signed
+}
+
+// signRRset returns the RRSIG for rrset, reusing a cached one while it's valid
+// for at least another half of its validity
+func signRRset(rrset []dns.RR) (dns.RR, error) {
+	k, err := getKeys()
+	if err != nil {
+		return nil, err
+	}
+	key := k.zsk
+	if rrset[0].Header().Rrtype == dns.TypeDNSKEY {
+		key = k.ksk
+	}
+
+	records := make([]string, len(rrset))
+	for i := range rrset {
+		records[i] = strings.ToLower(rrset[i].String())
+	}
+	sort.Strings(records)
+	id := fmt.Sprintf("%d|%s|%s", key.key.KeyTag(), zone(), strings.Join(records, "|"))
+
+	now := time.Now()
+	if sig := signatures.get(id, now.Add(signatureValidity/2)); sig != nil {
+		return sig, nil
+	}
+
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: rrset[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: rrset[0].Header().Ttl},
+		Algorithm:  key.key.Algorithm,
+		KeyTag:     key.key.KeyTag(),
+		SignerName: zone(),
+		Inception:  uint32(now.Add(-time.Hour).Unix()), // allow for clock skew
+		Expiration: uint32(now.Add(signatureValidity).Unix()),
+	}
+	if err := sig.Sign(key.signer, rrset); err != nil {
+		return nil, err
+	}
+
+	signatures.set(id, sig)
+	cp := *sig
+	return &cp, nil
+}
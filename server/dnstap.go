@@ -0,0 +1,363 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/nanopack/shaman/config"
+)
+
+// dnstapRetry is how long after a failure before the dnstap output is tried again
+const dnstapRetry = 5 * time.Second
+
+// dnstapContentType is what frame streams carry, for dnstap
+const dnstapContentType = "protobuf:dnstap.Dnstap"
+
+// dnstap message types (dnstap.proto's Message.Type)
+const (
+	dnstapClientQuery       = 5
+	dnstapClientResponse    = 6
+	dnstapForwarderQuery    = 7
+	dnstapForwarderResponse = 8
+)
+
+// frame streams control frame types, and the content type field
+const (
+	fstrmAccept      = 1
+	fstrmStart       = 2
+	fstrmStop        = 3
+	fstrmReady       = 4
+	fstrmFinish      = 5
+	fstrmContentType = 1
+)
+
+// dnstapMessage is a dnstap Message, as much of it as we fill in
+type dnstapMessage struct {
+	kind         int
+	tcp          bool     // asked over tcp (or tls, or https), rather than udp
+	queryAddr    net.Addr // who asked (nil for our queries to the fallback servers)
+	responseAddr net.Addr // who answered
+	queryTime    time.Time
+	query        []byte
+	responseTime time.Time
+	response     []byte
+}
+
+// tapper is a sink that takes dnstap messages beyond the answered queries
+type tapper interface {
+	tap(message *dnstapMessage) error
+}
+
+// dnstapSink writes dnstap messages as frame streams, to a collector's unix
+// socket or to a file: each query as a CLIENT_QUERY when received and a
+// CLIENT_RESPONSE when answered, and the queries to the fallback servers as
+// FORWARDER_QUERY and FORWARDER_RESPONSE
+type dnstapSink struct {
+	path   string
+	socket bool
+	out    io.WriteCloser
+	failed time.Time
+}
+
+func newDnstapSink(path string, socket bool) (*dnstapSink, error) {
+	if path == "" {
+		return nil, fmt.Errorf("No path")
+	}
+	self := &dnstapSink{path: path, socket: socket}
+	// a file that can't be written to won't get any better, unlike a socket
+	// whose collector isn't up yet
+	if !socket {
+		return self, self.open()
+	}
+	return self, nil
+}
+
+func (self *dnstapSink) log(query *loggedQuery) error {
+	message := &dnstapMessage{
+		kind:         dnstapClientResponse,
+		tcp:          query.record.Protocol == "tcp",
+		queryAddr:    query.client,
+		responseAddr: query.server,
+		queryTime:    query.record.Time,
+		responseTime: query.answered,
+	}
+	message.query, _ = query.query.Pack()
+	message.response, _ = query.response.Pack()
+	return self.tap(message)
+}
+
+func (self *dnstapSink) tap(message *dnstapMessage) error {
+	if self.out == nil {
+		if time.Since(self.failed) < dnstapRetry {
+			return fmt.Errorf("Dnstap output '%s' is down", self.path)
+		}
+		if err := self.open(); err != nil {
+			self.failed = time.Now()
+			return fmt.Errorf("Failed to open dnstap output '%s' - %v", self.path, err)
+		}
+	}
+
+	if conn, ok := self.out.(net.Conn); ok {
+		conn.SetWriteDeadline(time.Now().Add(dnstapRetry))
+	}
+	if err := writeFrame(self.out, message.marshal()); err != nil {
+		self.out.Close()
+		self.out, self.failed = nil, time.Now()
+		return fmt.Errorf("Failed to write to dnstap output '%s' - %v", self.path, err)
+	}
+	return nil
+}
+
+// open starts a frame stream: bidirectional to a socket, unidirectional to a
+// file (an earlier stream is rotated to path.1, as a file holds only one)
+func (self *dnstapSink) open() error {
+	if !self.socket {
+		if info, err := os.Stat(self.path); err == nil && info.Size() > 0 {
+			rotateFiles(self.path, config.QueryLogMaxFiles)
+		}
+		file, err := os.OpenFile(self.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		if err = writeControl(file, fstrmStart, true); err != nil {
+			file.Close()
+			return err
+		}
+		self.out = file
+		return nil
+	}
+
+	conn, err := net.DialTimeout("unix", self.path, dnstapRetry)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(dnstapRetry))
+
+	if err = writeControl(conn, fstrmReady, true); err == nil {
+		var ctype uint32
+		if ctype, err = readControl(conn); err == nil && ctype != fstrmAccept {
+			err = fmt.Errorf("Expected ACCEPT, got control frame %d", ctype)
+		}
+	}
+	if err == nil {
+		err = writeControl(conn, fstrmStart, true)
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	conn.SetDeadline(time.Time{})
+	self.out = conn
+	return nil
+}
+
+func (self *dnstapSink) close() error {
+	if self.out == nil {
+		return nil
+	}
+	defer self.out.Close()
+
+	conn, socket := self.out.(net.Conn)
+	if socket {
+		conn.SetDeadline(time.Now().Add(dnstapRetry))
+	}
+	if err := writeControl(self.out, fstrmStop, false); err != nil {
+		return err
+	}
+	if socket {
+		if ctype, err := readControl(conn); err != nil || ctype != fstrmFinish {
+			config.Log.Debug("Dnstap socket '%s' didn't finish the stream (%d) - %v", self.path, ctype, err)
+		}
+	}
+	return nil
+}
+
+// tapClientQuery sends the query to the dnstap sinks as a CLIENT_QUERY
+func tapClientQuery(res dns.ResponseWriter, req *dns.Msg) {
+	if !tapping() {
+		return
+	}
+	message := &dnstapMessage{
+		kind:         dnstapClientQuery,
+		tcp:          protocol(res.RemoteAddr()) == "tcp",
+		queryAddr:    res.RemoteAddr(),
+		responseAddr: res.LocalAddr(),
+		queryTime:    time.Now(),
+	}
+	message.query, _ = req.Pack()
+	tap(message)
+}
+
+// tapForwarder sends a query to the fallback server at addr (and its response,
+// if it answered) to the dnstap sinks, as a FORWARDER_QUERY or
+// FORWARDER_RESPONSE
+func tapForwarder(addr string, query, response *dns.Msg, queried time.Time) {
+	if !tapping() {
+		return
+	}
+	message := &dnstapMessage{kind: dnstapForwarderQuery, queryTime: queried}
+	if upstream, err := net.ResolveUDPAddr("udp", addr); err == nil {
+		message.responseAddr = upstream
+	}
+	message.query, _ = query.Pack()
+	if response != nil {
+		message.kind, message.responseTime = dnstapForwarderResponse, time.Now()
+		message.response, _ = response.Pack()
+	}
+	tap(message)
+}
+
+// tapping returns whether any sink takes dnstap messages (so they're only made
+// when they'll be sent)
+func tapping() bool {
+	return atomic.LoadInt32(&queryLog.tapping) == 1
+}
+
+// marshal encodes the message as a dnstap protobuf (a Dnstap holding a Message)
+func (self dnstapMessage) marshal() []byte {
+	var m []byte
+	m = appendVarintField(m, 1, uint64(self.kind))
+
+	queryIP, queryPort := addrParts(self.queryAddr)
+	responseIP, responsePort := addrParts(self.responseAddr)
+	family := responseIP
+	if queryIP != nil {
+		family = queryIP
+	}
+	if family != nil {
+		if family.To4() != nil {
+			m = appendVarintField(m, 2, 1) // INET
+		} else {
+			m = appendVarintField(m, 2, 2) // INET6
+		}
+	}
+	if self.tcp {
+		m = appendVarintField(m, 3, 2) // TCP
+	} else {
+		m = appendVarintField(m, 3, 1) // UDP
+	}
+	if queryIP != nil {
+		m = appendBytesField(m, 4, queryIP)
+		m = appendVarintField(m, 6, uint64(queryPort))
+	}
+	if responseIP != nil {
+		m = appendBytesField(m, 5, responseIP)
+		m = appendVarintField(m, 7, uint64(responsePort))
+	}
+	if !self.queryTime.IsZero() {
+		m = appendVarintField(m, 8, uint64(self.queryTime.Unix()))
+		m = appendFixed32Field(m, 9, uint32(self.queryTime.Nanosecond()))
+	}
+	if self.query != nil {
+		m = appendBytesField(m, 10, self.query)
+	}
+	if !self.responseTime.IsZero() {
+		m = appendVarintField(m, 12, uint64(self.responseTime.Unix()))
+		m = appendFixed32Field(m, 13, uint32(self.responseTime.Nanosecond()))
+	}
+	if self.response != nil {
+		m = appendBytesField(m, 14, self.response)
+	}
+
+	var d []byte
+	d = appendBytesField(d, 1, []byte(config.DnsListen)) // identity
+	d = appendBytesField(d, 2, []byte("shaman"))         // version
+	d = appendBytesField(d, 14, m)
+	d = appendVarintField(d, 15, 1) // MESSAGE
+	return d
+}
+
+// addrParts returns addr's ip (4 bytes for ipv4) and port
+func addrParts(addr net.Addr) (net.IP, int) {
+	var ip net.IP
+	var port int
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	default:
+		ip = addrIP(addr)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return ip, port
+}
+
+// protobuf wire format, for the few field types dnstap needs
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func appendVarintField(b []byte, field int, v uint64) []byte {
+	return appendVarint(appendVarint(b, uint64(field)<<3), v)
+}
+
+func appendBytesField(b []byte, field int, v []byte) []byte {
+	b = appendVarint(appendVarint(b, uint64(field)<<3|2), uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendFixed32Field(b []byte, field int, v uint32) []byte {
+	b = appendVarint(b, uint64(field)<<3|5)
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+// writeFrame writes a frame streams data frame
+func writeFrame(w io.Writer, data []byte) error {
+	frame := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	_, err := w.Write(append(frame, data...))
+	return err
+}
+
+// writeControl writes a frame streams control frame, with the dnstap content
+// type if withType
+func writeControl(w io.Writer, ctype uint32, withType bool) error {
+	control := make([]byte, 4)
+	binary.BigEndian.PutUint32(control, ctype)
+	if withType {
+		field := make([]byte, 8)
+		binary.BigEndian.PutUint32(field, fstrmContentType)
+		binary.BigEndian.PutUint32(field[4:], uint32(len(dnstapContentType)))
+		control = append(append(control, field...), dnstapContentType...)
+	}
+
+	frame := make([]byte, 8)
+	binary.BigEndian.PutUint32(frame[4:], uint32(len(control))) // escape, then length
+	_, err := w.Write(append(frame, control...))
+	return err
+}
+
+// readControl reads a frame streams control frame, returning its type
+func readControl(r io.Reader) (uint32, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, err
+	}
+	if binary.BigEndian.Uint32(header) != 0 {
+		return 0, fmt.Errorf("Expected a control frame")
+	}
+	length := binary.BigEndian.Uint32(header[4:])
+	if length < 4 || length > 512 {
+		return 0, fmt.Errorf("Bad control frame length %d", length)
+	}
+	control := make([]byte, length)
+	if _, err := io.ReadFull(r, control); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(control), nil
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+
+	"github.com/miekg/dns"
+
+	"github.com/nanopack/shaman/config"
+)
+
+// cookieSecret keys the server cookies handed to clients (RFC 7873)
+var cookieSecret = func() []byte {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return b
+}()
+
+// udpSize returns the largest udp response that may be sent to the client:
+// what it advertised, within what we advertise (RFC 6891 6.2.5)
+func udpSize(req *dns.Msg) int {
+	size := dns.MinMsgSize
+	if opt := req.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+	if size > config.EdnsUdpSize && config.EdnsUdpSize >= dns.MinMsgSize {
+		size = config.EdnsUdpSize
+	}
+	return size
+}
+
+// checkEdns0 returns the rcode for a request whose OPT record we can't accept
+// (unknown version, malformed options), or RcodeSuccess
+func checkEdns0(req *dns.Msg) int {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return dns.RcodeSuccess
+	}
+	if opt.Version() != 0 {
+		return dns.RcodeBadVers
+	}
+
+	for _, option := range opt.Option {
+		switch o := option.(type) {
+		case *dns.EDNS0_COOKIE:
+			// a client cookie, optionally followed by a server cookie
+			if n := len(o.Cookie) / 2; n != 8 && (n < 16 || n > 40) {
+				return dns.RcodeFormatError
+			}
+		case *dns.EDNS0_SUBNET:
+			if (o.Family == 1 && o.SourceNetmask > 32) || (o.Family == 2 && o.SourceNetmask > 128) || o.SourceScope != 0 {
+				return dns.RcodeFormatError
+			}
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// setEdns0 adds our OPT record to the response to a request that had one,
+// answering its cookie and echoing its client subnet with the scope the answer
+// was chosen on (or a forwarded response's, if there is one)
+func setEdns0(res dns.ResponseWriter, req, message *dns.Msg, scope int) {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	// replace any OPT record (from a forwarded response) with ours
+	var forwarded *dns.EDNS0_SUBNET
+	extra := make([]dns.RR, 0, len(message.Extra))
+	for _, rr := range message.Extra {
+		o, ok := rr.(*dns.OPT)
+		if !ok {
+			extra = append(extra, rr)
+			continue
+		}
+		for _, option := range o.Option {
+			if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+				forwarded = subnet
+			}
+		}
+	}
+
+	out := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	out.SetUDPSize(uint16(config.EdnsUdpSize))
+	if opt.Do() {
+		out.SetDo()
+	}
+
+	for _, option := range opt.Option {
+		switch o := option.(type) {
+		case *dns.EDNS0_COOKIE:
+			if len(o.Cookie) < 16 {
+				continue
+			}
+			client := o.Cookie[:16]
+			out.Option = append(out.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: client + serverCookie(client, res.RemoteAddr())})
+		case *dns.EDNS0_SUBNET:
+			echo := *o
+			echo.SourceScope = uint8(scope)
+			if forwarded != nil {
+				echo.SourceScope = forwarded.SourceScope
+			}
+			out.Option = append(out.Option, &echo)
+		}
+	}
+
+	message.Extra = append(extra, out)
+}
+
+// serverCookie returns the (hex) server cookie for the client cookie and address
+func serverCookie(client string, addr net.Addr) string {
+	mac := hmac.New(sha256.New, cookieSecret)
+	mac.Write([]byte(client))
+	if ip := addrIP(addr); ip != nil {
+		mac.Write(ip)
+	}
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// clientSubnet returns the network a query was made on behalf of: the EDNS
+// Client Subnet (RFC 7871) if there is one, otherwise the client's address
+func clientSubnet(res dns.ResponseWriter, req *dns.Msg) *net.IPNet {
+	if opt := req.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if subnet, ok := option.(*dns.EDNS0_SUBNET); ok && subnet.Address != nil {
+				bits := 32
+				if subnet.Family == 2 {
+					bits = 128
+				}
+				mask := net.CIDRMask(int(subnet.SourceNetmask), bits)
+				return &net.IPNet{IP: subnet.Address.Mask(mask), Mask: mask}
+			}
+		}
+	}
+
+	ip := addrIP(res.RemoteAddr())
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// addrIP returns the ip of addr, or nil
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	if addr == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/nanopack/shaman/config"
+)
+
+// forwardable returns whether a query for name should be relayed to the
+// fallback server (it's outside of our zone and view knows nothing about it)
+func forwardable(name, view string) bool {
+	name = strings.ToLower(name)
+	if config.DnsFallBack == "" || inZone(name) {
+		return false
+	}
+
+	if existsInView(name, view) || hasSubdomainInView(name, view) {
+		return false
+	}
+	if !config.ImplicitWildcard {
+		if _, err := wildcardRecord(name, view); err == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// forward relays the client's request to the fallback servers and returns the
+// upstream response (rcode, authority and additional sections included), or
+// SERVFAIL if no fallback server could be reached.
+func forward(req *dns.Msg) *dns.Msg {
+	r, err := exchange(req)
+	if err != nil {
+		config.Log.Debug("Failed to forward '%s' to fallback dns servers - %v", req.Question[0].Name, err)
+		return new(dns.Msg).SetRcode(req, dns.RcodeServerFailure)
+	}
+	r.Compress = true
+	return r
+}
+
+// exchange sends m to the fallback servers, unless the response is cached. The
+// query goes out with a fresh id (clients pick their own, which we shouldn't
+// trust upstream) and the response is returned with m's id. Cached responses
+// also get m's question back, as it was asked (in whatever case).
+func exchange(m *dns.Msg) (*dns.Msg, error) {
+	key, cacheable := newCacheKey(m)
+	if cacheable {
+		if r := responses.get(key); r != nil {
+			fallbackQueries.Inc("cached")
+			r.Id = m.Id
+			r.Question = m.Question
+			return r, nil
+		}
+	}
+
+	query := m.Copy()
+	query.Id = dns.Id()
+
+	r, err := getUpstreams().exchange(query)
+	if err != nil {
+		fallbackQueries.Inc("failed")
+		return nil, err
+	}
+	fallbackQueries.Inc("answered")
+
+	if cacheable {
+		responses.set(key, r)
+	}
+
+	r.Id = m.Id
+	return r, nil
+}
+
+// getAnswerFromFallBackServer gets records of qtype for qName from the fallback dns servers
+func getAnswerFromFallBackServer(qName string, qtype uint16) ([]dns.RR, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(qName), qtype)
+	m.RecursionDesired = true
+
+	r, err := exchange(m)
+	if err != nil {
+		return nil, err
+	}
+	return r.Answer, nil
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/nanopack/shaman/config"
+	sham "github.com/nanopack/shaman/core/common"
+)
+
+// requester is who a query is being answered for
+type requester struct {
+	subnet  *net.IPNet // the client's network (its EDNS client subnet, or address)
+	scope   int        // prefix length the answers were chosen on (the ECS scope)
+	forward bool       // whether its queries may be relayed to the fallback servers
+	view    string     // view it's answered from
+	source  string     // where its answer came from, for the query log
+}
+
+// localRecords returns the records meant for the requester. For each type,
+// those tagged with the most specific network containing it are preferred,
+// then the untagged ones (or, if every record is tagged, all of them).
+func localRecords(records []sham.Record, from *requester) []sham.Record {
+	types, byType := recordsByType(records)
+
+	local := make([]sham.Record, 0, len(records))
+	for _, rtype := range types {
+		var matched, untagged []sham.Record
+		best, tagged := -1, false
+		for _, record := range byType[rtype] {
+			if len(record.Subnets) == 0 {
+				untagged = append(untagged, record)
+				continue
+			}
+			tagged = true
+			bits := matchSubnets(record.Subnets, from.subnet)
+			switch {
+			case bits > best:
+				best, matched = bits, []sham.Record{record}
+			case bits == best && bits >= 0:
+				matched = append(matched, record)
+			}
+		}
+
+		// the answer depends on the client's whole subnet
+		if tagged && from.subnet != nil {
+			if ones, _ := from.subnet.Mask.Size(); ones > from.scope {
+				from.scope = ones
+			}
+		}
+
+		switch {
+		case best >= 0:
+			local = append(local, matched...)
+		case len(untagged) > 0:
+			local = append(local, untagged...)
+		default:
+			local = append(local, byType[rtype]...)
+		}
+	}
+	return local
+}
+
+// recordsByType groups records by type, returning the types in the order they
+// first appear
+func recordsByType(records []sham.Record) ([]string, map[string][]sham.Record) {
+	types := make([]string, 0)
+	byType := make(map[string][]sham.Record)
+	for i := range records {
+		rtype := strings.ToUpper(records[i].RType)
+		if _, ok := byType[rtype]; !ok {
+			types = append(types, rtype)
+		}
+		byType[rtype] = append(byType[rtype], records[i])
+	}
+	return types, byType
+}
+
+// matchSubnets returns the prefix length of the most specific of subnets (cidrs,
+// ips or region names) that contains client, or -1 if none do
+func matchSubnets(subnets []string, client *net.IPNet) int {
+	if client == nil {
+		return -1
+	}
+	clientOnes, clientBits := client.Mask.Size()
+
+	best := -1
+	for _, network := range networks(subnets) {
+		ones, bits := network.Mask.Size()
+		// a network narrower than the client's can't be said to contain it
+		if bits != clientBits || ones > clientOnes {
+			continue
+		}
+		if network.Contains(client.IP) && ones > best {
+			best = ones
+		}
+	}
+	return best
+}
+
+// regionNetworks holds the configured regions' networks by name, loaded at start
+var regionNetworks = make(map[string][]*net.IPNet)
+
+// networks returns the networks of subnets, expanding region names
+func networks(subnets []string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(subnets))
+	for _, subnet := range subnets {
+		subnet = strings.TrimSpace(subnet)
+		if n, ok := regionNetworks[strings.ToLower(subnet)]; ok {
+			nets = append(nets, n...)
+		} else if n := parseNetwork(subnet); n != nil {
+			nets = append(nets, n)
+		} else {
+			config.Log.Debug("Unknown subnet or region '%s'", subnet)
+		}
+	}
+	return nets
+}
+
+// loadRegions parses the configured regions. Regions look like `name=cidr`,
+// listed once per network.
+func loadRegions() error {
+	regions := make(map[string][]*net.IPNet)
+	for _, region := range strings.Split(config.Regions, ",") {
+		if strings.TrimSpace(region) == "" {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimSpace(region), "=", 2)
+		name := ""
+		if len(parts) == 2 {
+			name = strings.ToLower(strings.TrimSpace(parts[0]))
+		}
+		if name == "" {
+			return fmt.Errorf("Bad region '%s' - expected 'name=cidr'", region)
+		}
+		n := parseNetwork(parts[1])
+		if n == nil {
+			return fmt.Errorf("Bad region '%s' - '%s' isn't a cidr", parts[0], parts[1])
+		}
+		regions[name] = append(regions[name], n)
+	}
+	regionNetworks = regions
+	return nil
+}
+
+// parseNetwork parses a cidr (or an ip, as a single address network), or
+// returns nil
+func parseNetwork(network string) *net.IPNet {
+	network = strings.TrimSpace(network)
+	if _, n, err := net.ParseCIDR(network); err == nil {
+		return n
+	}
+	ip := net.ParseIP(network)
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}
+}
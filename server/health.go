@@ -0,0 +1,262 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nanopack/shaman/config"
+	"github.com/nanopack/shaman/core"
+	sham "github.com/nanopack/shaman/core/common"
+)
+
+// checks are the health checks running for the records that declare them
+var checks = &healthChecks{running: make(map[string]*healthCheck)}
+
+// HealthStatus describes a health checked record
+type HealthStatus struct {
+	Domain  string    `json:"domain"`          // domain the record is at
+	RType   string    `json:"type"`            // record type
+	Address string    `json:"address"`         // record address
+	Check   string    `json:"check"`           // what is checked (`tcp 10.0.0.1:80`)
+	Healthy bool      `json:"healthy"`         // whether the record is answered with
+	Checked time.Time `json:"checked"`         // when it was last checked (zero if not yet)
+	Error   string    `json:"error,omitempty"` // why the last check failed
+}
+
+type healthChecks struct {
+	sync.Mutex
+	running map[string]*healthCheck
+
+	// syncing serializes syncChecks, whose records are listed before the lock
+	// is taken (so answers don't wait on the cache)
+	syncing sync.Mutex
+}
+
+// healthCheck is a record's check and its results
+type healthCheck struct {
+	sync.Mutex
+	domain string
+	record sham.Record
+	stop   chan struct{}
+
+	healthy bool
+	passes  int // consecutive passes
+	fails   int // consecutive failures
+	checked time.Time
+	err     error
+}
+
+// GetHealth returns the state of every health checked record
+func GetHealth() []HealthStatus {
+	checks.Lock()
+	statuses := make([]HealthStatus, 0, len(checks.running))
+	for _, check := range checks.running {
+		statuses = append(statuses, check.status())
+	}
+	checks.Unlock()
+
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Domain != statuses[j].Domain {
+			return statuses[i].Domain < statuses[j].Domain
+		}
+		return statuses[i].Address < statuses[j].Address
+	})
+	return statuses
+}
+
+// syncChecks starts the checks of new records and stops those of records that
+// are gone or have changed
+func syncChecks() {
+	checks.syncing.Lock()
+	defer checks.syncing.Unlock()
+
+	resources := shaman.ListRecords()
+
+	checks.Lock()
+	defer checks.Unlock()
+
+	wanted := make(map[string]bool)
+	for _, resource := range resources {
+		for _, record := range resource.Records {
+			if record.Check == nil {
+				continue
+			}
+			key := checkKey(resource.Domain, record)
+			wanted[key] = true
+			if _, ok := checks.running[key]; ok {
+				continue
+			}
+
+			if err := validCheck(record.Check); err != nil {
+				config.Log.Error("Bad health check for '%s' %s - %v", resource.Domain, record.Address, err)
+				continue
+			}
+			check := &healthCheck{domain: resource.Domain, record: record, stop: make(chan struct{}), healthy: true}
+			checks.running[key] = check
+			go check.run()
+		}
+	}
+
+	for key, check := range checks.running {
+		if !wanted[key] {
+			close(check.stop)
+			delete(checks.running, key)
+		}
+	}
+}
+
+// healthyRecords returns the records of resource whose checks pass. When every
+// record of a type fails, they are all returned (better a record that may work
+// than none at all).
+func healthyRecords(resource sham.Resource) []sham.Record {
+	types, byType := recordsByType(resource.Records)
+
+	healthy := make([]sham.Record, 0, len(resource.Records))
+	for _, rtype := range types {
+		passing := make([]sham.Record, 0, len(byType[rtype]))
+		for _, record := range byType[rtype] {
+			if isHealthy(resource.Domain, record) {
+				passing = append(passing, record)
+			}
+		}
+		if len(passing) == 0 {
+			passing = byType[rtype]
+		}
+		healthy = append(healthy, passing...)
+	}
+	return healthy
+}
+
+// isHealthy returns whether the record at domain passes its check (records
+// without one, or not yet checked, always do)
+func isHealthy(domain string, record sham.Record) bool {
+	if record.Check == nil {
+		return true
+	}
+	checks.Lock()
+	check, ok := checks.running[checkKey(domain, record)]
+	checks.Unlock()
+	if !ok {
+		return true
+	}
+
+	check.Lock()
+	defer check.Unlock()
+	return check.healthy
+}
+
+// checkKey identifies the check of a record
+func checkKey(domain string, record sham.Record) string {
+	return fmt.Sprintf("%s|%s|%s|%+v", strings.ToLower(domain), strings.ToUpper(record.RType), record.Address, *record.Check)
+}
+
+// validCheck returns why check can't be run, if it can't
+func validCheck(check *sham.Check) error {
+	if check.Target == "" {
+		return fmt.Errorf("No target")
+	}
+	switch check.Type {
+	case "tcp", "http":
+		return nil
+	case "exec":
+		if !config.HealthExec {
+			return fmt.Errorf("Exec checks aren't enabled")
+		}
+		return nil
+	}
+	return fmt.Errorf("Unknown type '%s'", check.Type)
+}
+
+// run checks the record every interval until stopped
+func (self *healthCheck) run() {
+	ticker := time.NewTicker(time.Duration(self.record.Check.Interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		self.check()
+		select {
+		case <-ticker.C:
+		case <-self.stop:
+			return
+		}
+	}
+}
+
+// check runs the check once, changing the record's health once it has passed
+// (or failed) enough times in a row
+func (self *healthCheck) check() {
+	check := self.record.Check
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(check.Timeout)*time.Second)
+	defer cancel()
+
+	var err error
+	switch check.Type {
+	case "tcp":
+		var conn net.Conn
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", check.Target)
+		if err == nil {
+			conn.Close()
+		}
+	case "http":
+		var req *http.Request
+		req, err = http.NewRequest("GET", check.Target, nil)
+		if err != nil {
+			break
+		}
+		var res *http.Response
+		res, err = http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			break
+		}
+		res.Body.Close()
+		if res.StatusCode != check.Status {
+			err = fmt.Errorf("Expected status %d, got %d", check.Status, res.StatusCode)
+		}
+	case "exec":
+		err = exec.CommandContext(ctx, "sh", "-c", check.Target).Run()
+	}
+
+	self.Lock()
+	defer self.Unlock()
+	self.checked, self.err = time.Now(), err
+	if err != nil {
+		self.passes = 0
+		self.fails++
+		if self.healthy && self.fails >= check.Fall {
+			config.Log.Info("'%s' %s is down - %v", self.domain, self.record.Address, err)
+			self.healthy = false
+		}
+		return
+	}
+
+	self.fails = 0
+	self.passes++
+	if !self.healthy && self.passes >= check.Rise {
+		config.Log.Info("'%s' %s is back up", self.domain, self.record.Address)
+		self.healthy = true
+	}
+}
+
+func (self *healthCheck) status() HealthStatus {
+	self.Lock()
+	defer self.Unlock()
+	status := HealthStatus{
+		Domain:  self.domain,
+		RType:   self.record.RType,
+		Address: self.record.Address,
+		Check:   self.record.Check.Type + " " + self.record.Check.Target,
+		Healthy: self.healthy,
+		Checked: self.checked,
+	}
+	if self.err != nil {
+		status.Error = self.err.Error()
+	}
+	return status
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"github.com/miekg/dns"
+
+	"github.com/nanopack/shaman/metrics"
+)
+
+var (
+	queriesAnswered = metrics.NewCounterVec("shaman_dns_queries_total",
+		"Queries answered, by type asked and response code", "qtype", "rcode")
+	fallbackQueries = metrics.NewCounterVec("shaman_fallback_queries_total",
+		"Queries for the fallback dns servers, by whether they were answered from the cache, upstream, or not at all", "result")
+	fallbackDuration = metrics.NewHistogramVec("shaman_fallback_duration_seconds",
+		"Time each fallback dns server took to answer (or fail)", metrics.DefaultBuckets, "server", "result")
+)
+
+// countingWriter counts the first response written to a query
+type countingWriter struct {
+	dns.ResponseWriter
+	req     *dns.Msg
+	counted bool
+}
+
+// countQueries returns res, wrapped to count the response to req by type and rcode
+func countQueries(res dns.ResponseWriter, req *dns.Msg) dns.ResponseWriter {
+	return &countingWriter{ResponseWriter: res, req: req}
+}
+
+// WriteMsg writes the response, counting it if it's the first
+func (self *countingWriter) WriteMsg(m *dns.Msg) error {
+	if !self.counted {
+		self.counted = true
+		qtype := ""
+		if len(self.req.Question) > 0 {
+			qtype = dns.TypeToString[self.req.Question[0].Qtype]
+		}
+		queriesAnswered.Inc(qtype, dns.RcodeToString[m.Rcode])
+	}
+	return self.ResponseWriter.WriteMsg(m)
+}
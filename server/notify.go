@@ -0,0 +1,92 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/nanopack/shaman/config"
+)
+
+var (
+	// notifyTimeout is how long to wait on a secondary to acknowledge a NOTIFY
+	notifyTimeout = 2 * time.Second
+	// notifyBackoff is the wait before the first resend, doubling after each
+	notifyBackoff = time.Second
+
+	secondaries     = make(map[string]chan struct{})
+	secondariesLock sync.Mutex
+)
+
+// notifySecondaries tells every configured secondary that the zone changed.
+// Each secondary is notified in the background, and changes made while a
+// NOTIFY is outstanding are folded into the next one.
+func notifySecondaries(serial uint32) {
+	if zone() == "" || config.Notify == "" {
+		return
+	}
+
+	secondariesLock.Lock()
+	defer secondariesLock.Unlock()
+	for _, addr := range strings.Split(config.Notify, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "53")
+		}
+
+		pending, ok := secondaries[addr]
+		if !ok {
+			pending = make(chan struct{}, 1)
+			secondaries[addr] = pending
+			go notifier(addr, pending)
+		}
+
+		select {
+		case pending <- struct{}{}:
+		default: // already due to be notified
+		}
+	}
+}
+
+// notifier sends a NOTIFY to addr whenever one is pending
+func notifier(addr string, pending chan struct{}) {
+	for range pending {
+		notify(addr)
+	}
+}
+
+// notify sends a NOTIFY for the zone to addr, resending with exponential
+// backoff until it is acknowledged or config.NotifyRetries runs out
+func notify(addr string) {
+	backoff := notifyBackoff
+	for try := 0; ; try++ {
+		message := new(dns.Msg)
+		message.SetNotify(zone())
+		message.Authoritative = true
+		message.Answer = []dns.RR{soa()}
+
+		r, _, err := (&dns.Client{Net: "udp", Timeout: notifyTimeout}).Exchange(message, addr)
+		if err == nil && r.Rcode == dns.RcodeSuccess {
+			config.Log.Debug("Secondary '%s' acknowledged NOTIFY for '%s' (serial %d)", addr, zone(), message.Answer[0].(*dns.SOA).Serial)
+			return
+		}
+		if err == nil {
+			err = fmt.Errorf("Responded %v", dns.RcodeToString[r.Rcode])
+		}
+
+		if try >= config.NotifyRetries {
+			config.Log.Error("Secondary '%s' never acknowledged NOTIFY for '%s' - %v", addr, zone(), err)
+			return
+		}
+		config.Log.Debug("Secondary '%s' didn't acknowledge NOTIFY for '%s', retrying in %v - %v", addr, zone(), backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nanopack/shaman/config"
+	sham "github.com/nanopack/shaman/core/common"
+)
+
+// answer policies, for the records of each type in an answer
+const (
+	policyAll      = "all"      // every record, as stored
+	policyShuffle  = "shuffle"  // every record, in a random (weighted) order
+	policyWeighted = "weighted" // a single record, picked by weight
+	policyTop      = "top"      // `answers` records, picked by weight
+)
+
+// shuffler picks records (math/rand's sources aren't safe for concurrent use)
+var shuffler = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// applyPolicy returns the records of resource as its answer policy has them
+func applyPolicy(resource sham.Resource) []sham.Record {
+	policy := strings.ToLower(resource.Policy)
+	if policy == "" || policy == policyAll || len(resource.Records) < 2 {
+		return resource.Records
+	}
+
+	count := 0 // as many as there are
+	switch policy {
+	case policyShuffle:
+	case policyWeighted:
+		count = 1
+	case policyTop:
+		count = resource.Answers
+	default:
+		config.Log.Debug("Unknown answer policy '%s' for '%s'", resource.Policy, resource.Domain)
+		return resource.Records
+	}
+
+	types, byType := recordsByType(resource.Records)
+
+	records := make([]sham.Record, 0, len(resource.Records))
+	for _, rtype := range types {
+		picked := weightedShuffle(byType[rtype])
+		if count > 0 && count < len(picked) {
+			picked = picked[:count]
+		}
+		records = append(records, picked...)
+	}
+	return records
+}
+
+// weightedShuffle returns records in a random order, each record's chance of
+// coming next being proportional to its weight (1 if unset)
+func weightedShuffle(records []sham.Record) []sham.Record {
+	left := make([]sham.Record, len(records))
+	copy(left, records)
+
+	shuffler.Lock()
+	defer shuffler.Unlock()
+
+	shuffled := make([]sham.Record, 0, len(records))
+	for len(left) > 0 {
+		total := 0
+		for i := range left {
+			total += weight(left[i])
+		}
+		n := shuffler.Intn(total)
+		i := 0
+		for ; n >= weight(left[i]); i++ {
+			n -= weight(left[i])
+		}
+		shuffled = append(shuffled, left[i])
+		left = append(left[:i], left[i+1:]...)
+	}
+	return shuffled
+}
+
+// weight returns the record's weight, 1 unless set
+func weight(record sham.Record) int {
+	if record.Weight <= 0 {
+		return 1
+	}
+	return record.Weight
+}
@@ -0,0 +1,429 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/nanopack/shaman/config"
+)
+
+// queryLogBuffer is how many queries wait to be written before more are dropped
+// (the log must never hold up answers)
+const queryLogBuffer = 1024
+
+// where answers came from
+const (
+	sourceLocal    = "local"    // our records
+	sourceWildcard = "wildcard" // synthesized from a wildcard record
+	sourceFallback = "fallback" // the fallback dns servers
+)
+
+// queryLog is the query log, when enabled
+var queryLog = &queryLogger{}
+
+// QueryRecord is what the query log records about a query
+type QueryRecord struct {
+	Time     time.Time `json:"time"`     // when the query was received
+	Client   string    `json:"client"`   // client's address
+	Protocol string    `json:"protocol"` // udp or tcp
+	Name     string    `json:"qname"`    // name asked for
+	Type     string    `json:"qtype"`    // type asked for
+	Rcode    string    `json:"rcode"`    // response code answered with
+	Answers  int       `json:"answers"`  // records answered with
+	Latency  float64   `json:"latency"`  // milliseconds taken to answer
+	Source   string    `json:"source"`   // where the answer came from (local, wildcard or fallback)
+}
+
+// QueryLogStatus describes the query log
+type QueryLogStatus struct {
+	Enabled bool     `json:"enabled"` // whether queries are being logged
+	Sinks   []string `json:"sinks"`   // where they're logged to
+	Logged  uint64   `json:"logged"`  // queries logged
+	Dropped uint64   `json:"dropped"` // queries not logged because the sinks couldn't keep up
+	Errors  uint64   `json:"errors"`  // failed writes to the sinks
+}
+
+// loggedQuery is a query and its response, as handed to the sinks
+type loggedQuery struct {
+	record   QueryRecord
+	query    *dns.Msg
+	response *dns.Msg
+	client   net.Addr
+	server   net.Addr
+	answered time.Time
+
+	// set instead, for the dnstap messages that aren't an answered query
+	tapped *dnstapMessage
+}
+
+// querySink is somewhere queries are logged to
+type querySink interface {
+	log(query *loggedQuery) error
+	close() error
+}
+
+type queryLogger struct {
+	sync.RWMutex
+	enabled int32 // read without the lock on every query
+	tapping int32 // whether any open sink takes dnstap messages
+	sinks   []string
+	open    []querySink
+	queries chan *loggedQuery
+	done    chan struct{}
+
+	logged  uint64
+	dropped uint64
+	errors  uint64
+}
+
+// queryLogWriter logs the first response written to a query
+type queryLogWriter struct {
+	dns.ResponseWriter
+	req    *dns.Msg
+	from   *requester
+	start  time.Time
+	logged bool
+}
+
+// GetQueryLog returns the query log's state
+func GetQueryLog() QueryLogStatus {
+	queryLog.RLock()
+	defer queryLog.RUnlock()
+	return QueryLogStatus{
+		Enabled: atomic.LoadInt32(&queryLog.enabled) == 1,
+		Sinks:   append([]string{}, queryLog.sinks...),
+		Logged:  atomic.LoadUint64(&queryLog.logged),
+		Dropped: atomic.LoadUint64(&queryLog.dropped),
+		Errors:  atomic.LoadUint64(&queryLog.errors),
+	}
+}
+
+// SetQueryLog turns the query log on or off, logging to sinks (or, if nil, to
+// those it last logged to, or the configured ones). Only configured sinks can
+// be logged to, so where queries are written is up to the config alone.
+func SetQueryLog(enabled bool, sinks []string) error {
+	queryLog.Lock()
+	defer queryLog.Unlock()
+
+	configured := querySinks(config.QueryLog)
+	if sinks == nil {
+		sinks = queryLog.sinks
+	}
+	if sinks == nil {
+		sinks = configured
+	}
+	for _, sink := range sinks {
+		if !hasSink(configured, sink) {
+			return fmt.Errorf("Query log sink '%s' isn't configured - expected one of '%s'", sink, config.QueryLog)
+		}
+	}
+
+	// open the new sinks before closing the old, so a bad one changes nothing
+	var open []querySink
+	if enabled {
+		if len(sinks) == 0 {
+			return fmt.Errorf("No query log sinks")
+		}
+		for _, sink := range sinks {
+			s, err := openSink(sink)
+			if err != nil {
+				for i := range open {
+					open[i].close()
+				}
+				return fmt.Errorf("Failed to open query log sink '%s' - %v", sink, err)
+			}
+			open = append(open, s)
+		}
+	}
+
+	queryLog.stop()
+	queryLog.sinks = sinks
+	if enabled {
+		queryLog.start(open)
+		config.Log.Info("Logging queries to %s", strings.Join(sinks, ", "))
+	}
+	return nil
+}
+
+// querySinks splits a comma separated list of sinks
+func querySinks(sinks string) []string {
+	split := make([]string, 0)
+	for _, sink := range strings.Split(sinks, ",") {
+		if sink = strings.TrimSpace(sink); sink != "" {
+			split = append(split, sink)
+		}
+	}
+	return split
+}
+
+// hasSink returns whether sinks has sink
+func hasSink(sinks []string, sink string) bool {
+	for i := range sinks {
+		if sinks[i] == sink {
+			return true
+		}
+	}
+	return false
+}
+
+// openSink opens the sink described by a url (stdout://, file:///path,
+// dnstap:///socket or dnstap-file:///path)
+func openSink(sink string) (querySink, error) {
+	u, err := url.Parse(sink)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "stdout":
+		return &jsonSink{encoder: json.NewEncoder(os.Stdout)}, nil
+	case "file":
+		return openFileSink(u.Path, int64(config.QueryLogMaxSize)<<20, config.QueryLogMaxFiles)
+	case "dnstap":
+		return newDnstapSink(u.Path, true)
+	case "dnstap-file":
+		return newDnstapSink(u.Path, false)
+	}
+	return nil, fmt.Errorf("Unknown sink type '%s'", u.Scheme)
+}
+
+// start starts writing queries to sinks, the lock held
+func (self *queryLogger) start(sinks []querySink) {
+	self.open = sinks
+	self.queries = make(chan *loggedQuery, queryLogBuffer)
+	self.done = make(chan struct{})
+	go self.write(self.queries, self.done)
+	for i := range sinks {
+		if _, ok := sinks[i].(tapper); ok {
+			atomic.StoreInt32(&self.tapping, 1)
+		}
+	}
+	atomic.StoreInt32(&self.enabled, 1)
+}
+
+// stop writes out the queries waiting to be and closes the sinks, the lock held
+func (self *queryLogger) stop() {
+	if atomic.LoadInt32(&self.enabled) == 0 {
+		return
+	}
+	atomic.StoreInt32(&self.enabled, 0)
+	atomic.StoreInt32(&self.tapping, 0)
+	close(self.queries)
+	<-self.done
+	for i := range self.open {
+		if err := self.open[i].close(); err != nil {
+			config.Log.Error("Failed to close query log sink - %v", err)
+		}
+	}
+	self.open = nil
+}
+
+// write writes the queries to the sinks until there are no more
+func (self *queryLogger) write(queries chan *loggedQuery, done chan struct{}) {
+	defer close(done)
+	for query := range queries {
+		if query.tapped != nil {
+			self.tap(query.tapped)
+			continue
+		}
+		for i := range self.open {
+			if err := self.open[i].log(query); err != nil {
+				// a sink that's down fails every query, so only some are worth logging
+				if n := atomic.AddUint64(&self.errors, 1); n%1000 == 1 {
+					config.Log.Error("Failed to log query - %v", err)
+				}
+			}
+		}
+		atomic.AddUint64(&self.logged, 1)
+	}
+}
+
+// tap writes a dnstap message to the sinks that take them
+func (self *queryLogger) tap(message *dnstapMessage) {
+	for i := range self.open {
+		if t, ok := self.open[i].(tapper); ok {
+			if err := t.tap(message); err != nil {
+				if n := atomic.AddUint64(&self.errors, 1); n%1000 == 1 {
+					config.Log.Error("Failed to write dnstap message - %v", err)
+				}
+			}
+		}
+	}
+}
+
+// log hands query to the sinks, dropping it if they're behind
+func (self *queryLogger) log(query *loggedQuery) {
+	self.RLock()
+	defer self.RUnlock()
+	if atomic.LoadInt32(&self.enabled) == 0 {
+		return
+	}
+	select {
+	case self.queries <- query:
+	default:
+		atomic.AddUint64(&self.dropped, 1)
+	}
+}
+
+// tap hands a dnstap message to the sinks that take them
+func tap(message *dnstapMessage) {
+	queryLog.log(&loggedQuery{tapped: message})
+}
+
+// logQueries returns res, wrapped to log the response to req (answered for
+// from) if the query log is enabled
+func logQueries(res dns.ResponseWriter, req *dns.Msg, from *requester) dns.ResponseWriter {
+	if atomic.LoadInt32(&queryLog.enabled) == 0 {
+		return res
+	}
+	return &queryLogWriter{ResponseWriter: res, req: req, from: from, start: time.Now()}
+}
+
+// WriteMsg writes the response, logging it if it's the first (transfers write
+// several)
+func (self *queryLogWriter) WriteMsg(m *dns.Msg) error {
+	err := self.ResponseWriter.WriteMsg(m)
+	if self.logged {
+		return err
+	}
+	self.logged = true
+
+	answered := time.Now()
+	record := QueryRecord{
+		Time:     self.start,
+		Client:   self.RemoteAddr().String(),
+		Protocol: protocol(self.RemoteAddr()),
+		Rcode:    dns.RcodeToString[m.Rcode],
+		Answers:  len(m.Answer),
+		Latency:  float64(answered.Sub(self.start)) / float64(time.Millisecond),
+		Source:   self.from.source,
+	}
+	if ip := addrIP(self.RemoteAddr()); ip != nil {
+		record.Client = ip.String()
+	}
+	if len(self.req.Question) > 0 {
+		record.Name = self.req.Question[0].Name
+		record.Type = dns.TypeToString[self.req.Question[0].Qtype]
+	}
+
+	queryLog.log(&loggedQuery{
+		record:   record,
+		query:    self.req,
+		response: m,
+		client:   self.RemoteAddr(),
+		server:   self.LocalAddr(),
+		answered: answered,
+	})
+	return err
+}
+
+// protocol returns the protocol a client at addr asked over (tls and https
+// being over tcp)
+func protocol(addr net.Addr) string {
+	if _, ok := addr.(*net.UDPAddr); ok {
+		return "udp"
+	}
+	return "tcp"
+}
+
+// jsonSink logs queries as lines of json
+type jsonSink struct {
+	encoder *json.Encoder
+}
+
+func (self *jsonSink) log(query *loggedQuery) error {
+	return self.encoder.Encode(query.record)
+}
+
+func (self *jsonSink) close() error {
+	return nil
+}
+
+// fileSink logs queries as lines of json to a file, rotated once it grows to
+// maxSize (to path.1, path.2, ... keeping maxFiles)
+type fileSink struct {
+	jsonSink
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+func openFileSink(path string, maxSize int64, maxFiles int) (*fileSink, error) {
+	if path == "" {
+		return nil, fmt.Errorf("No path")
+	}
+	self := &fileSink{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	return self, self.open()
+}
+
+func (self *fileSink) open() error {
+	if err := os.MkdirAll(filepath.Dir(self.path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(self.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	self.file, self.size = file, info.Size()
+	self.encoder = json.NewEncoder(self)
+	return nil
+}
+
+// Write writes a line to the file, rotating it first if the line won't fit
+func (self *fileSink) Write(b []byte) (int, error) {
+	if self.maxSize > 0 && self.size > 0 && self.size+int64(len(b)) > self.maxSize {
+		if err := self.rotate(); err != nil {
+			return 0, fmt.Errorf("Failed to rotate - %v", err)
+		}
+	}
+	n, err := self.file.Write(b)
+	self.size += int64(n)
+	return n, err
+}
+
+// rotate moves each file along (dropping the oldest) and starts a new one
+func (self *fileSink) rotate() error {
+	self.file.Close()
+	rotateFiles(self.path, self.maxFiles)
+	return self.open()
+}
+
+// rotateFiles moves path to path.1, path.1 to path.2, ... keeping maxFiles
+// (path is removed if none are kept)
+func rotateFiles(path string, maxFiles int) {
+	for i := maxFiles; i > 0; i-- {
+		older := fmt.Sprintf("%s.%d", path, i)
+		newer := fmt.Sprintf("%s.%d", path, i-1)
+		if i == 1 {
+			newer = path
+		}
+		if i == maxFiles {
+			os.Remove(older)
+		}
+		os.Rename(newer, older)
+	}
+	if maxFiles <= 0 {
+		os.Remove(path)
+	}
+}
+
+func (self *fileSink) close() error {
+	return self.file.Close()
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/nanopack/shaman/config"
+)
+
+// rateLimitIdle is how long a client network's bucket is kept once it's full
+const rateLimitIdle = 10 * time.Second
+
+var (
+	queryLimits    = newRateLimiter() // queries from each client network
+	responseLimits = newRateLimiter() // identical responses to each client network (rrl)
+
+	rateLimitStats     RateLimitStats
+	rateLimitStatsLock sync.Mutex
+)
+
+// RateLimitStats counts the queries and responses held back by rate limiting
+type RateLimitStats struct {
+	Limited uint64 `json:"limited"` // queries dropped for coming too fast
+	Dropped uint64 `json:"dropped"` // responses dropped by rrl
+	Slipped uint64 `json:"slipped"` // responses sent truncated by rrl, so real clients retry over tcp
+}
+
+// rrl actions for a response
+const (
+	rrlSend = iota
+	rrlDrop
+	rrlSlip
+)
+
+// rateLimiter is a token bucket per key, each refilling at a rate a second
+type rateLimiter struct {
+	sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	over   int // responses over the limit, for slipping every nth
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*bucket)}
+}
+
+// GetRateLimitStats returns the rate limiting counters
+func GetRateLimitStats() RateLimitStats {
+	rateLimitStatsLock.Lock()
+	defer rateLimitStatsLock.Unlock()
+	return rateLimitStats
+}
+
+// allowQuery returns whether a query from addr may be answered (dropped
+// otherwise, so floods can't use us to swamp anyone)
+func allowQuery(addr net.Addr) bool {
+	if config.RateLimit <= 0 {
+		return true
+	}
+	network := clientNetwork(addr)
+	if network == "" {
+		return true
+	}
+
+	if ok, _ := queryLimits.take(network, config.RateLimit); ok {
+		return true
+	}
+	rateLimitStatsLock.Lock()
+	rateLimitStats.Limited++
+	rateLimitStatsLock.Unlock()
+	config.Log.Trace("Rate limited query from %v", addr)
+	return false
+}
+
+// rrl returns what to do with message, a response to addr: send it, or, once
+// too many of the same have been sent, drop it or slip a truncated one
+// through in its place (response rate limiting)
+func rrl(addr net.Addr, message *dns.Msg) int {
+	if config.RrlResponses <= 0 {
+		return rrlSend
+	}
+	network := clientNetwork(addr)
+	if network == "" {
+		return rrlSend
+	}
+
+	ok, over := responseLimits.take(network+"|"+responseKey(message), config.RrlResponses)
+	if ok {
+		return rrlSend
+	}
+
+	rateLimitStatsLock.Lock()
+	defer rateLimitStatsLock.Unlock()
+	if config.RrlSlip > 0 && over%config.RrlSlip == 0 {
+		rateLimitStats.Slipped++
+		return rrlSlip
+	}
+	rateLimitStats.Dropped++
+	return rrlDrop
+}
+
+// slipped returns the truncated, empty response sent in place of one dropped
+// by rrl
+func slipped(req *dns.Msg) *dns.Msg {
+	message := new(dns.Msg).SetReply(req)
+	message.Truncated = true
+	return message
+}
+
+// responseKey returns what makes responses "identical" for rrl: the name and
+// type answered, with all names that don't exist in a zone (or every error)
+// counted together, so random names can't get around the limit
+func responseKey(message *dns.Msg) string {
+	name, qtype := "", ""
+	if len(message.Question) > 0 {
+		name = strings.ToLower(message.Question[0].Name)
+		qtype = dns.TypeToString[message.Question[0].Qtype]
+	}
+
+	switch {
+	case message.Rcode == dns.RcodeNameError:
+		for _, rr := range message.Ns {
+			if rr.Header().Rrtype == dns.TypeSOA {
+				name = strings.ToLower(rr.Header().Name)
+			}
+		}
+		return "nxdomain|" + name
+	case message.Rcode != dns.RcodeSuccess:
+		return "error|" + dns.RcodeToString[message.Rcode]
+	case len(message.Answer) == 0:
+		return "nodata|" + name + "|" + qtype
+	}
+	return "answer|" + name + "|" + qtype
+}
+
+// checkPrefixes refuses prefix lengths clients can't be grouped by
+func checkPrefixes() error {
+	if config.RateLimitIpv4Prefix < 0 || config.RateLimitIpv4Prefix > 32 {
+		return fmt.Errorf("Bad rate-limit-ipv4-prefix '%d' - expected 0 to 32", config.RateLimitIpv4Prefix)
+	}
+	if config.RateLimitIpv6Prefix < 0 || config.RateLimitIpv6Prefix > 128 {
+		return fmt.Errorf("Bad rate-limit-ipv6-prefix '%d' - expected 0 to 128", config.RateLimitIpv6Prefix)
+	}
+	return nil
+}
+
+// clientNetwork returns the network addr is rate limited as part of
+func clientNetwork(addr net.Addr) string {
+	ip := addrIP(addr)
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(config.RateLimitIpv4Prefix, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(config.RateLimitIpv6Prefix, 128)).String()
+}
+
+// take takes a token from key's bucket, returning whether there was one and,
+// if not, how many times in a row there wasn't
+func (self *rateLimiter) take(key string, rate int) (bool, int) {
+	now := time.Now()
+	self.Lock()
+	defer self.Unlock()
+	self.sweep(now)
+
+	b, ok := self.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(rate), last: now}
+		self.buckets[key] = b
+	}
+
+	// refill for the time since, up to a second's worth
+	b.tokens += now.Sub(b.last).Seconds() * float64(rate)
+	if b.tokens > float64(rate) {
+		b.tokens = float64(rate)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		b.over++
+		return false, b.over
+	}
+	b.tokens--
+	b.over = 0
+	return true, 0
+}
+
+// sweep drops the buckets that have been idle long enough to be full again,
+// at most every rateLimitIdle
+func (self *rateLimiter) sweep(now time.Time) {
+	if now.Sub(self.swept) < rateLimitIdle {
+		return
+	}
+	self.swept = now
+	for key, b := range self.buckets {
+		if now.Sub(b.last) > rateLimitIdle {
+			delete(self.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+	nanoauth "github.com/nanobox-io/golang-nanoauth"
+
+	"github.com/nanopack/shaman/config"
+)
+
+// tlsListener returns the DNS-over-TLS listener (RFC 7858), or nil if it's
+// not enabled
+func tlsListener() (*dns.Server, error) {
+	if config.DnsTlsListen == "" {
+		return nil, nil
+	}
+
+	cert, err := tlsCertificate()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to generate or load dns cert - %v", err)
+	}
+
+	// default to the well known port
+	addr := config.DnsTlsListen
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "853")
+	}
+
+	return &dns.Server{
+		Addr:          addr,
+		Net:           "tcp-tls",
+		TLSConfig:     &tls.Config{Certificates: []tls.Certificate{*cert}},
+		TsigSecret:    tsigSecrets(),
+		MsgAcceptFunc: acceptMsg,
+	}, nil
+}
+
+// tlsCertificate loads the dedicated dns cert pair if set, otherwise the api's,
+// generating one if neither was passed
+func tlsCertificate() (*tls.Certificate, error) {
+	switch {
+	case config.DnsTlsCrt != "":
+		return nanoauth.Load(config.DnsTlsCrt, config.DnsTlsKey, "")
+	case config.ApiCrt != "":
+		return nanoauth.Load(config.ApiCrt, config.ApiKey, config.ApiKeyPassword)
+	default:
+		return nanoauth.Generate(config.ApiDomain)
+	}
+}
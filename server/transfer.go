@@ -0,0 +1,201 @@
+package server
+
+import (
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/nanopack/shaman/config"
+	"github.com/nanopack/shaman/core"
+	sham "github.com/nanopack/shaman/core/common"
+)
+
+// transferChunk is the most records sent in a single transfer message
+const transferChunk = 100
+
+// transfer answers AXFR and IXFR requests for the zone, from allowed clients or
+// those signing with a permitted key
+func transfer(res dns.ResponseWriter, req *dns.Msg) {
+	question := req.Question[0]
+	_, udp := res.RemoteAddr().(*net.UDPAddr)
+
+	// clients on the allow-list, or signing with a permitted key
+	allowed := transferAllowed(res.RemoteAddr())
+	if key, ok := signedBy(res, req); ok && keyPermitted(key, config.TransferKeys) {
+		allowed = true
+	}
+
+	rcode := dns.RcodeSuccess
+	switch {
+	case zone() == "" || strings.ToLower(question.Name) != zone():
+		rcode = dns.RcodeNotAuth
+	case !allowed:
+		rcode = dns.RcodeRefused
+	case udp && question.Qtype == dns.TypeAXFR:
+		// full transfers are tcp only (RFC 5936)
+		rcode = dns.RcodeFormatError
+	}
+	if rcode != dns.RcodeSuccess {
+		config.Log.Info("Refused %s of '%s' to %v", dns.TypeToString[question.Qtype], question.Name, res.RemoteAddr())
+		message := new(dns.Msg).SetRcode(req, rcode)
+		sign(res, req, message)
+		res.WriteMsg(message)
+		return
+	}
+
+	// secondaries get the zone as their view sees it
+	view := selectView(res, req)
+	var records []dns.RR
+	if question.Qtype == dns.TypeIXFR {
+		records = incrementalTransfer(req, view)
+	} else {
+		records = fullTransfer(view)
+	}
+	config.Log.Debug("Transferring '%s' (%d records) to %v", question.Name, len(records), res.RemoteAddr())
+
+	if udp {
+		message := new(dns.Msg).SetReply(req)
+		message.Authoritative = true
+		message.Answer = records
+		// if it won't fit, the current SOA tells the client to retry over tcp (RFC 1995)
+		if message.Len() > udpSize(req) {
+			message.Answer = records[:1]
+		}
+		sign(res, req, message)
+		res.WriteMsg(message)
+		return
+	}
+
+	for len(records) > 0 {
+		n := transferChunk
+		if n > len(records) {
+			n = len(records)
+		}
+		message := new(dns.Msg).SetReply(req)
+		message.Authoritative = true
+		message.Answer = records[:n]
+		sign(res, req, message)
+		if err := res.WriteMsg(message); err != nil {
+			config.Log.Debug("Failed to send zone transfer to %v - %v", res.RemoteAddr(), err)
+			return
+		}
+		// later messages only sign their timers (RFC 2845 4.4)
+		res.TsigTimersOnly(true)
+		records = records[n:]
+	}
+}
+
+// fullTransfer returns the whole zone as seen from view, framed by its SOA
+// (RFC 5936)
+func fullTransfer(view string) []dns.RR {
+	resources := viewResources(shaman.ListRecords(), view)
+	sort.Slice(resources, func(i, j int) bool { return resources[i].Domain < resources[j].Domain })
+
+	records := []dns.RR{soa()}
+	storedNs := false
+	for _, rr := range zoneRecords(resources) {
+		if rr.Header().Rrtype == dns.TypeNS && strings.ToLower(rr.Header().Name) == zone() {
+			storedNs = true
+		}
+		records = append(records, rr)
+	}
+	if !storedNs {
+		records = append(records[:1], append([]dns.RR{ns()}, records[1:]...)...)
+	}
+	return append(records, soa())
+}
+
+// incrementalTransfer returns the changes seen from view since the client's
+// serial (RFC 1995), a lone SOA if the client is current, or the whole zone if
+// the changes since then aren't known.
+func incrementalTransfer(req *dns.Msg, view string) []dns.RR {
+	var since *dns.SOA
+	for _, rr := range req.Ns {
+		if s, ok := rr.(*dns.SOA); ok {
+			since = s
+			break
+		}
+	}
+	if since == nil {
+		return fullTransfer(view)
+	}
+
+	changes, ok := shaman.Changes(since.Serial)
+	if !ok {
+		return fullTransfer(view)
+	}
+
+	current := soa().(*dns.SOA)
+	if len(changes) > 0 && changes[len(changes)-1].Serial != current.Serial {
+		// changed since we looked
+		current.Serial = changes[len(changes)-1].Serial
+	}
+	if len(changes) == 0 {
+		return []dns.RR{current}
+	}
+
+	records := []dns.RR{current}
+	for _, change := range changes {
+		removed, added := difference(zoneRecords(viewResources(change.Removed, view)), zoneRecords(viewResources(change.Added, view)))
+		records = append(records, serialSoa(change.Serial-1))
+		records = append(records, removed...)
+		records = append(records, serialSoa(change.Serial))
+		records = append(records, added...)
+	}
+	return append(records, current)
+}
+
+// zoneRecords returns the records of resources that belong in the zone (the
+// apex SOA is always synthesized)
+func zoneRecords(resources []sham.Resource) []dns.RR {
+	records := make([]dns.RR, 0)
+	for i := range resources {
+		for _, record := range resources[i].StringSlice() {
+			rr, err := dns.NewRR(record)
+			if err != nil {
+				config.Log.Debug("Failed to create RR from record - %v", err)
+				continue
+			}
+			name := strings.ToLower(rr.Header().Name)
+			if !inZone(name) || (name == zone() && rr.Header().Rrtype == dns.TypeSOA) {
+				continue
+			}
+			records = append(records, rr)
+		}
+	}
+	return records
+}
+
+// difference returns the records only in before, and those only in after
+func difference(before, after []dns.RR) ([]dns.RR, []dns.RR) {
+	set := func(rrs []dns.RR) map[string]bool {
+		in := make(map[string]bool, len(rrs))
+		for i := range rrs {
+			in[strings.ToLower(rrs[i].String())] = true
+		}
+		return in
+	}
+	inBefore, inAfter := set(before), set(after)
+
+	removed, added := make([]dns.RR, 0), make([]dns.RR, 0)
+	for _, rr := range before {
+		if !inAfter[strings.ToLower(rr.String())] {
+			removed = append(removed, rr)
+		}
+	}
+	for _, rr := range after {
+		if !inBefore[strings.ToLower(rr.String())] {
+			added = append(added, rr)
+		}
+	}
+	return removed, added
+}
+
+// serialSoa returns the zone's SOA as it was at serial
+func serialSoa(serial uint32) dns.RR {
+	s := soa().(*dns.SOA)
+	s.Serial = serial
+	return s
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/nanopack/shaman/config"
+)
+
+// tsigKey is a secret shared with clients to sign their requests (RFC 2845)
+type tsigKey struct {
+	name      string // canonical (lowercase, rooted) key name
+	given     string // rooted key name, as configured
+	algorithm string // e.g. `hmac-sha256.`
+	secret    string // base64 encoded
+}
+
+// tsigAlgorithms are the hmacs keys may use
+var tsigAlgorithms = []string{dns.HmacMD5, dns.HmacSHA1, dns.HmacSHA256, dns.HmacSHA512}
+
+// tsigKeyring holds the configured keys by (canonical) name, loaded at start
+var tsigKeyring = make(map[string]tsigKey)
+
+// loadTsigKeys parses the configured keys. Keys look like
+// `[algorithm:]name:secret`, the algorithm defaulting to hmac-sha256.
+func loadTsigKeys() error {
+	keys := make(map[string]tsigKey)
+	for _, key := range strings.Split(config.TsigKeys, ",") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		parts := strings.Split(key, ":")
+		if len(parts) == 2 {
+			parts = append([]string{"hmac-sha256"}, parts...)
+		}
+		if len(parts) != 3 || parts[1] == "" || parts[2] == "" {
+			return fmt.Errorf("Bad tsig key '%s' - expected '[algorithm:]name:secret'", key)
+		}
+
+		k := tsigKey{
+			name:      strings.ToLower(dns.Fqdn(parts[1])),
+			given:     dns.Fqdn(parts[1]),
+			algorithm: strings.ToLower(dns.Fqdn(parts[0])),
+			secret:    parts[2],
+		}
+		supported := false
+		for i := range tsigAlgorithms {
+			supported = supported || k.algorithm == tsigAlgorithms[i]
+		}
+		if !supported {
+			return fmt.Errorf("Bad tsig key '%s' - unsupported algorithm '%s'", parts[1], parts[0])
+		}
+		keys[k.name] = k
+	}
+	tsigKeyring = keys
+	return nil
+}
+
+// tsigSecrets returns the secrets the listeners verify signed requests with
+func tsigSecrets() map[string]string {
+	// never nil, so signatures are always checked
+	secrets := make(map[string]string)
+	for _, key := range tsigKeyring {
+		// the listeners look secrets up by the name as signed with, so both the
+		// configured and canonical forms are there
+		secrets[key.given] = key.secret
+		secrets[key.name] = key.secret
+	}
+	return secrets
+}
+
+// signedBy returns the name of the key req was validly signed with, if any
+func signedBy(res dns.ResponseWriter, req *dns.Msg) (string, bool) {
+	t := req.IsTsig()
+	if t == nil {
+		return "", false
+	}
+	key, ok := tsigKeyring[strings.ToLower(t.Hdr.Name)]
+	if !ok || strings.ToLower(t.Algorithm) != key.algorithm {
+		return "", false
+	}
+	if err := res.TsigStatus(); err != nil {
+		config.Log.Debug("Bad signature from %v with key '%s' - %v", res.RemoteAddr(), key.name, err)
+		return "", false
+	}
+	return key.name, true
+}
+
+// keyPermitted returns whether key is among the (comma separated) key names
+// in allowed
+func keyPermitted(key, allowed string) bool {
+	for _, name := range strings.Split(allowed, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" && strings.ToLower(dns.Fqdn(name)) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// sign signs the response to a validly signed request with the same key
+func sign(res dns.ResponseWriter, req, message *dns.Msg) {
+	if _, ok := signedBy(res, req); ok {
+		t := req.IsTsig()
+		message.SetTsig(strings.ToLower(t.Hdr.Name), t.Algorithm, t.Fudge, time.Now().Unix())
+	}
+}
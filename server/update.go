@@ -0,0 +1,355 @@
+package server
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+
+	"github.com/nanopack/shaman/config"
+	"github.com/nanopack/shaman/core"
+	sham "github.com/nanopack/shaman/core/common"
+)
+
+// updateLock serializes dynamic updates, so prerequisites hold while applied
+var updateLock sync.Mutex
+
+// acceptMsg is the listeners' MsgAcceptFunc: miekg/dns' default (which
+// answers any opcode but QUERY and NOTIFY with NOTIMP), but letting dynamic
+// updates (RFC 2136) through
+func acceptMsg(dh dns.Header) dns.MsgAcceptAction {
+	action := dns.DefaultMsgAcceptFunc(dh)
+	if action != dns.MsgRejectNotImplemented {
+		return action
+	}
+	// the opcode, read as the default does
+	if opcode := int(dh.Bits>>11) & 0xF; opcode == dns.OpcodeUpdate {
+		return dns.MsgAccept
+	}
+	return action
+}
+
+// update applies a dynamic update (RFC 2136) signed with a configured key
+func update(res dns.ResponseWriter, req *dns.Msg) *dns.Msg {
+	message := new(dns.Msg)
+	message.SetRcode(req, updateRcode(res, req))
+	return message
+}
+
+// updateRcode checks and applies the update, returning the outcome
+func updateRcode(res dns.ResponseWriter, req *dns.Msg) int {
+	if len(req.Question) != 1 || req.Question[0].Qtype != dns.TypeSOA {
+		return dns.RcodeFormatError
+	}
+	if zone() == "" || strings.ToLower(req.Question[0].Name) != zone() {
+		return dns.RcodeNotAuth
+	}
+	key, ok := signedBy(res, req)
+	if !ok {
+		config.Log.Info("Refused unsigned update from %v", res.RemoteAddr())
+		return dns.RcodeRefused
+	}
+	if config.UpdateKeys != "" && !keyPermitted(key, config.UpdateKeys) {
+		config.Log.Info("Refused update from %v - key '%s' may not update", res.RemoteAddr(), key)
+		return dns.RcodeRefused
+	}
+
+	updateLock.Lock()
+	defer updateLock.Unlock()
+
+	if rcode := checkPrerequisites(req.Answer); rcode != dns.RcodeSuccess {
+		return rcode
+	}
+	if rcode := checkUpdates(req.Ns); rcode != dns.RcodeSuccess {
+		return rcode
+	}
+
+	config.Log.Debug("Applying update from %v signed by '%s'", res.RemoteAddr(), key)
+	return applyUpdates(req.Ns)
+}
+
+// checkPrerequisites returns whether the prerequisites hold (RFC 2136 3.2)
+func checkPrerequisites(prereqs []dns.RR) int {
+	// value dependent prerequisites are compared by rrset once all are known
+	type rrset struct {
+		name  string
+		rtype uint16
+	}
+	expected := make(map[rrset][]dns.RR)
+
+	for _, rr := range prereqs {
+		hdr := rr.Header()
+		name := strings.ToLower(hdr.Name)
+		if hdr.Ttl != 0 {
+			return dns.RcodeFormatError
+		}
+		if !inZone(name) {
+			return dns.RcodeNotZone
+		}
+
+		records := zoneRecordsFor(name)
+		switch hdr.Class {
+		case dns.ClassANY:
+			if hdr.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			if hdr.Rrtype == dns.TypeANY {
+				if len(records) == 0 {
+					return dns.RcodeNameError
+				}
+			} else if len(ofType(records, hdr.Rrtype)) == 0 {
+				return dns.RcodeNXRrset
+			}
+		case dns.ClassNONE:
+			if hdr.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			if hdr.Rrtype == dns.TypeANY {
+				if len(records) > 0 {
+					return dns.RcodeYXDomain
+				}
+			} else if len(ofType(records, hdr.Rrtype)) > 0 {
+				return dns.RcodeYXRrset
+			}
+		case dns.ClassINET:
+			set := rrset{name, hdr.Rrtype}
+			expected[set] = append(expected[set], rr)
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+
+	for set, rrs := range expected {
+		have := ofType(zoneRecordsFor(set.name), set.rtype)
+		if !sameRecords(have, rrs) || !sameRecords(rrs, have) {
+			return dns.RcodeNXRrset
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// checkUpdates returns whether the updates are well formed (RFC 2136 3.4.1)
+func checkUpdates(updates []dns.RR) int {
+	for _, rr := range updates {
+		hdr := rr.Header()
+		if !inZone(hdr.Name) {
+			return dns.RcodeNotZone
+		}
+
+		meta := hdr.Rrtype == dns.TypeAXFR || hdr.Rrtype == dns.TypeIXFR ||
+			hdr.Rrtype == dns.TypeMAILA || hdr.Rrtype == dns.TypeMAILB
+		switch hdr.Class {
+		case dns.ClassINET:
+			if meta || hdr.Rrtype == dns.TypeANY {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassANY:
+			if meta || hdr.Ttl != 0 || hdr.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassNONE:
+			if meta || hdr.Ttl != 0 {
+				return dns.RcodeFormatError
+			}
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// applyUpdates adds and removes records as the updates say (RFC 2136 3.4.2),
+// then saves every changed domain at once, so either all of the update is
+// applied or none of it is
+func applyUpdates(updates []dns.RR) int {
+	names := make([]string, 0)
+	records := make(map[string][]dns.RR)
+	for _, rr := range updates {
+		hdr := rr.Header()
+		name := strings.ToLower(hdr.Name)
+		if _, ok := records[name]; !ok {
+			names = append(names, name)
+			records[name] = storedRecords(name)
+		}
+		// the apex SOA is always synthesized
+		if name == zone() && hdr.Rrtype == dns.TypeSOA {
+			continue
+		}
+
+		current := records[name]
+		switch hdr.Class {
+		case dns.ClassINET:
+			cnames := len(ofType(current, dns.TypeCNAME))
+			if (hdr.Rrtype == dns.TypeCNAME && len(current) > cnames) || (hdr.Rrtype != dns.TypeCNAME && cnames > 0) {
+				// an alias can't share its name with other records
+				continue
+			}
+			updated := make([]dns.RR, 0, len(current)+1)
+			for _, have := range current {
+				// a cname is replaced, as is the same record with another ttl
+				if have.Header().Rrtype == dns.TypeCNAME && hdr.Rrtype == dns.TypeCNAME || sameRecord(have, rr) {
+					continue
+				}
+				updated = append(updated, have)
+			}
+			records[name] = append(updated, rr)
+		case dns.ClassANY:
+			// the apex keeps its name servers (RFC 2136 3.4.2.3)
+			if name == zone() && hdr.Rrtype == dns.TypeNS {
+				continue
+			}
+			updated := make([]dns.RR, 0, len(current))
+			for _, have := range current {
+				keep := name == zone() && have.Header().Rrtype == dns.TypeNS
+				if keep || hdr.Rrtype != dns.TypeANY && have.Header().Rrtype != hdr.Rrtype {
+					updated = append(updated, have)
+				}
+			}
+			records[name] = updated
+		case dns.ClassNONE:
+			updated := make([]dns.RR, 0, len(current))
+			for _, have := range current {
+				if !sameRecord(have, rr) {
+					updated = append(updated, have)
+				}
+			}
+			// nor is the apex left without name servers (RFC 2136 3.4.2.4)
+			if name == zone() && hdr.Rrtype == dns.TypeNS && len(ofType(updated, dns.TypeNS)) == 0 {
+				continue
+			}
+			records[name] = updated
+		}
+	}
+
+	changed := make([]sham.Resource, 0, len(names))
+	deleted := make([]string, 0)
+	for _, name := range names {
+		resource := sham.Resource{Domain: name, Records: make([]sham.Record, 0)}
+		if stored, err := shaman.GetRecord(name); err == nil {
+			resource.Policy, resource.Answers, resource.Views = stored.Policy, stored.Answers, stored.Views
+		}
+		for _, rr := range records[name] {
+			record := sham.Record{
+				TTL:     int(rr.Header().Ttl),
+				Class:   "IN",
+				RType:   dns.TypeToString[rr.Header().Rrtype],
+				Address: rdata(rr),
+			}
+			// keep what dns can't express about records that stay
+			if stored, ok := storedRecord(name, rr); ok {
+				record.Subnets, record.Weight, record.Check, record.Views = stored.Subnets, stored.Weight, stored.Check, stored.Views
+			}
+			resource.Records = append(resource.Records, record)
+		}
+
+		switch {
+		case len(resource.Records) > 0:
+			changed = append(changed, resource)
+		case shaman.Exists(name):
+			deleted = append(deleted, name)
+		}
+	}
+
+	if err := shaman.ChangeRecords(changed, deleted); err != nil {
+		config.Log.Error("Failed to apply update - %v", err)
+		return dns.RcodeServerFailure
+	}
+	return dns.RcodeSuccess
+}
+
+// storedRecords returns the records stored for name
+func storedRecords(name string) []dns.RR {
+	resource, err := shaman.GetRecord(name)
+	if err != nil {
+		return make([]dns.RR, 0)
+	}
+	return resourceRecords(resource)
+}
+
+// resourceRecords returns resource's records as resource records
+func resourceRecords(resource sham.Resource) []dns.RR {
+	records := make([]dns.RR, 0, len(resource.Records))
+	for _, record := range resource.StringSlice() {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			config.Log.Debug("Failed to create RR from record - %v", err)
+			continue
+		}
+		records = append(records, rr)
+	}
+	return records
+}
+
+// storedRecord returns the stored record at name that rr is the same as
+func storedRecord(name string, rr dns.RR) (sham.Record, bool) {
+	resource, err := shaman.GetRecord(name)
+	if err != nil {
+		return sham.Record{}, false
+	}
+	for i, record := range resource.StringSlice() {
+		have, err := dns.NewRR(record)
+		if err == nil && sameRecord(have, rr) {
+			return resource.Records[i], true
+		}
+	}
+	return sham.Record{}, false
+}
+
+// zoneRecordsFor returns the records at name as served, synthesized apex
+// records included
+func zoneRecordsFor(name string) []dns.RR {
+	return withApex(name, storedRecords(name))
+}
+
+// withApex adds the synthesized apex records to records at name
+func withApex(name string, records []dns.RR) []dns.RR {
+	if name != zone() {
+		return records
+	}
+
+	apex := []dns.RR{soa()}
+	if len(ofType(records, dns.TypeNS)) == 0 {
+		apex = append(apex, ns())
+	}
+	for _, rr := range records {
+		if rr.Header().Rrtype != dns.TypeSOA {
+			apex = append(apex, rr)
+		}
+	}
+	return apex
+}
+
+// ofType returns the records of type rtype
+func ofType(records []dns.RR, rtype uint16) []dns.RR {
+	matches := make([]dns.RR, 0)
+	for _, rr := range records {
+		if rr.Header().Rrtype == rtype {
+			matches = append(matches, rr)
+		}
+	}
+	return matches
+}
+
+// sameRecord returns whether a and b are the same record, ignoring ttl and class
+func sameRecord(a, b dns.RR) bool {
+	return a.Header().Rrtype == b.Header().Rrtype && strings.EqualFold(rdata(a), rdata(b))
+}
+
+// sameRecords returns whether every record in a is also in b
+func sameRecords(a, b []dns.RR) bool {
+	for i := range a {
+		found := false
+		for j := range b {
+			found = found || sameRecord(a[i], b[j])
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// rdata returns the presentation format of rr's data, as shaman stores it
+func rdata(rr dns.RR) string {
+	return strings.TrimPrefix(rr.String(), rr.Header().String())
+}
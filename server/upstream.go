@@ -0,0 +1,206 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/nanopack/shaman/config"
+)
+
+var (
+	errNoUpstreams = errors.New("No fallback dns servers configured")
+
+	pool     *upstreams
+	poolLock sync.Mutex
+)
+
+// upstream is a single fallback dns server and its health
+type upstream struct {
+	sync.Mutex
+	addr    string
+	timeout time.Duration
+	fails   int           // consecutive failures
+	down    bool          // skipped until a probe or query succeeds
+	rtt     time.Duration // smoothed round trip time
+}
+
+// upstreams is the set of fallback dns servers built from config
+type upstreams struct {
+	list   []*upstream
+	next   uint32 // round-robin position
+	source string // config it was built from
+}
+
+// getUpstreams returns the fallback servers, rebuilding them if the config
+// has changed since they were last built.
+func getUpstreams() *upstreams {
+	source := config.DnsFallBack + "|" + config.FallBackTimeout.String()
+
+	poolLock.Lock()
+	defer poolLock.Unlock()
+	if pool != nil && pool.source == source {
+		return pool
+	}
+
+	pool = &upstreams{source: source}
+	for _, addr := range strings.Split(config.DnsFallBack, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+
+		// per-upstream timeout (ip:port@timeout)
+		timeout := config.FallBackTimeout
+		if i := strings.LastIndex(addr, "@"); i > 0 {
+			t, err := time.ParseDuration(addr[i+1:])
+			if err != nil {
+				config.Log.Error("Bad timeout for fallback dns server '%s' - %v", addr, err)
+			} else {
+				timeout = t
+			}
+			addr = addr[:i]
+		}
+
+		pool.list = append(pool.list, &upstream{addr: addr, timeout: timeout})
+	}
+	return pool
+}
+
+// checkFallBackPolicy refuses a fallback-policy the upstreams can't be ordered by
+func checkFallBackPolicy() error {
+	switch config.FallBackPolicy {
+	case "sequential", "round-robin", "fastest":
+		return nil
+	}
+	return fmt.Errorf("Bad fallback-policy '%s' - expected 'sequential', 'round-robin' or 'fastest'", config.FallBackPolicy)
+}
+
+// order returns the upstreams in the order they should be tried for the
+// configured policy. Servers that are down go last, so a query is still
+// attempted when every server is down.
+func (self *upstreams) order() []*upstream {
+	ordered := make([]*upstream, len(self.list))
+	copy(ordered, self.list)
+	if len(ordered) == 0 {
+		return ordered
+	}
+
+	switch config.FallBackPolicy {
+	case "round-robin":
+		n := int(atomic.AddUint32(&self.next, 1)-1) % len(ordered)
+		ordered = append(ordered[n:], ordered[:n]...)
+	case "fastest":
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return ordered[i].latency() < ordered[j].latency()
+		})
+	}
+
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return !ordered[i].isDown() && ordered[j].isDown()
+	})
+	return ordered
+}
+
+// exchange sends query to each upstream in turn until one answers. If every
+// one fails, the last SERVFAIL or REFUSED reply (if any) is returned.
+func (self *upstreams) exchange(query *dns.Msg) (*dns.Msg, error) {
+	var last *dns.Msg
+	err := errNoUpstreams
+	for _, u := range self.order() {
+		var r *dns.Msg
+		queried := time.Now()
+		tapForwarder(u.addr, query, nil, queried)
+		r, err = u.exchange(query)
+		if r != nil {
+			tapForwarder(u.addr, query, r, queried)
+		}
+		if err == nil {
+			fallbackDuration.Observe(time.Since(queried).Seconds(), u.addr, "answered")
+			return r, nil
+		}
+		fallbackDuration.Observe(time.Since(queried).Seconds(), u.addr, "failed")
+		config.Log.Debug("Fallback dns server '%s' failed - %v", u.addr, err)
+		if r != nil {
+			last = r
+		}
+	}
+	if last != nil {
+		return last, nil
+	}
+	return nil, err
+}
+
+// exchange sends query to the upstream over udp, retrying over tcp if the
+// response was truncated, and records the outcome. A SERVFAIL or REFUSED
+// reply counts as a failure, and is returned along with the error.
+func (self *upstream) exchange(query *dns.Msg) (*dns.Msg, error) {
+	r, rtt, err := (&dns.Client{Net: "udp", Timeout: self.timeout}).Exchange(query, self.addr)
+	if err == nil && r.Truncated {
+		r, rtt, err = (&dns.Client{Net: "tcp", Timeout: self.timeout}).Exchange(query, self.addr)
+	}
+	if err != nil {
+		r = nil
+	} else if r.Rcode == dns.RcodeServerFailure || r.Rcode == dns.RcodeRefused {
+		err = fmt.Errorf("Answered %s", dns.RcodeToString[r.Rcode])
+	}
+
+	self.Lock()
+	defer self.Unlock()
+	if err != nil {
+		self.fails++
+		if !self.down && self.fails >= config.FallBackMaxFails {
+			config.Log.Info("Fallback dns server '%s' is down - %v", self.addr, err)
+			self.down = true
+		}
+		return r, err
+	}
+
+	if self.down {
+		config.Log.Info("Fallback dns server '%s' is back up", self.addr)
+	}
+	self.fails = 0
+	self.down = false
+	if self.rtt == 0 {
+		self.rtt = rtt
+	} else {
+		self.rtt = (self.rtt*7 + rtt) / 8
+	}
+	return r, nil
+}
+
+func (self *upstream) isDown() bool {
+	self.Lock()
+	defer self.Unlock()
+	return self.down
+}
+
+// latency returns the smoothed round trip time (untried servers are fastest)
+func (self *upstream) latency() time.Duration {
+	self.Lock()
+	defer self.Unlock()
+	return self.rtt
+}
+
+// checkUpstreams periodically probes every fallback server so dead ones are
+// noticed (and recovered ones brought back) without waiting on client queries
+func checkUpstreams() {
+	if config.FallBackHealthInterval <= 0 {
+		return
+	}
+
+	for range time.Tick(config.FallBackHealthInterval) {
+		for _, u := range getUpstreams().list {
+			probe := new(dns.Msg)
+			probe.SetQuestion(".", dns.TypeNS)
+			// any response but SERVFAIL or REFUSED means it's alive
+			u.exchange(probe)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+
+	"github.com/nanopack/shaman/config"
+	"github.com/nanopack/shaman/core"
+	sham "github.com/nanopack/shaman/core/common"
+)
+
+var errNotInView = errors.New("Not in view")
+
+// View describes a configured view
+type View struct {
+	Name    string   `json:"name"`    // view name
+	Clients []string `json:"clients"` // networks (or `key:name` tsig keys) the view is selected by
+	Domains []string `json:"domains"` // domains with records answered in the view
+}
+
+// viewEntry is a single way of selecting a view
+type viewEntry struct {
+	name    string
+	client  string     // as configured
+	network *net.IPNet // nil for `any` and keys
+	key     string     // canonical tsig key name
+}
+
+// viewEntries holds the configured views' entries in order, loaded at start
+var viewEntries = make([]viewEntry, 0)
+
+// names indexes the names with domains beneath them, per view
+var names = &viewNames{}
+
+// viewNames is, for each view asked about, the set of names that domains seen
+// from it are beneath. It's dropped whenever the records change (and rebuilt
+// by the change listener), so queries don't list every record.
+type viewNames struct {
+	sync.RWMutex
+	serial uint32                     // records' serial the index was built at
+	views  map[string]map[string]bool // view -> parent names
+}
+
+// loadViews parses the configured views. Views look like `name=cidr`,
+// `name=key:keyname` or `name=any`, listed once per entry.
+func loadViews() error {
+	entries := make([]viewEntry, 0)
+	for _, view := range strings.Split(config.Views, ",") {
+		if strings.TrimSpace(view) == "" {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimSpace(view), "=", 2)
+		name := ""
+		if len(parts) == 2 {
+			name = strings.ToLower(strings.TrimSpace(parts[0]))
+		}
+		if name == "" {
+			return fmt.Errorf("Bad view '%s' - expected 'name=cidr', 'name=key:keyname' or 'name=any'", view)
+		}
+
+		entry := viewEntry{name: name, client: strings.TrimSpace(parts[1])}
+		switch {
+		case strings.ToLower(entry.client) == "any":
+		case strings.HasPrefix(strings.ToLower(entry.client), "key:"):
+			entry.key = strings.ToLower(dns.Fqdn(strings.TrimSpace(entry.client[4:])))
+			if _, ok := tsigKeyring[entry.key]; !ok {
+				return fmt.Errorf("Bad view '%s' - no tsig key '%s'", parts[0], entry.key)
+			}
+		default:
+			if entry.network = parseNetwork(entry.client); entry.network == nil {
+				return fmt.Errorf("Bad view '%s' - '%s' isn't a cidr", parts[0], parts[1])
+			}
+		}
+		entries = append(entries, entry)
+	}
+	viewEntries = entries
+	return nil
+}
+
+// selectView returns the view req is answered from: the first configured view
+// the client's address is in, or whose key it signed with, or "" (only records
+// without views are answered for clients in no view)
+func selectView(res dns.ResponseWriter, req *dns.Msg) string {
+	key, signed := signedBy(res, req)
+	ip := addrIP(res.RemoteAddr())
+
+	for _, entry := range viewEntries {
+		switch {
+		case entry.key != "":
+			if signed && entry.key == key {
+				return entry.name
+			}
+		case entry.network == nil:
+			return entry.name
+		case ip != nil && entry.network.Contains(ip):
+			return entry.name
+		}
+	}
+	return ""
+}
+
+// inView returns whether something scoped to views is seen from view
+func inView(views []string, view string) bool {
+	if len(views) == 0 {
+		return true
+	}
+	for i := range views {
+		if strings.EqualFold(strings.TrimSpace(views[i]), view) {
+			return true
+		}
+	}
+	return false
+}
+
+// viewResource returns resource with only the records seen from view, or
+// errNotInView if the domain isn't
+func viewResource(resource sham.Resource, view string) (sham.Resource, error) {
+	if !inView(resource.Views, view) {
+		return sham.Resource{}, errNotInView
+	}
+
+	records := make([]sham.Record, 0, len(resource.Records))
+	for _, record := range resource.Records {
+		if inView(record.Views, view) {
+			records = append(records, record)
+		}
+	}
+	resource.Records = records
+	return resource, nil
+}
+
+// viewResources returns the resources (and their records) seen from view
+func viewResources(resources []sham.Resource, view string) []sham.Resource {
+	visible := make([]sham.Resource, 0, len(resources))
+	for i := range resources {
+		if resource, err := viewResource(resources[i], view); err == nil && len(resource.Records) > 0 {
+			visible = append(visible, resource)
+		}
+	}
+	return visible
+}
+
+// existsInView returns whether name has records seen from view
+func existsInView(name, view string) bool {
+	resource, err := shaman.GetRecord(name)
+	if err != nil {
+		return false
+	}
+	resource, err = viewResource(resource, view)
+	return err == nil && len(resource.Records) > 0
+}
+
+// hasSubdomainInView returns whether any domain beneath name is seen from view
+func hasSubdomainInView(name, view string) bool {
+	return names.parents(view)[strings.ToLower(dns.Fqdn(name))]
+}
+
+// parents returns the names with domains seen from view beneath them, indexing
+// the view if it isn't yet (or the records have changed since)
+func (self *viewNames) parents(view string) map[string]bool {
+	serial := shaman.Serial()
+	self.RLock()
+	parents, ok := self.views[view]
+	current := self.serial == serial
+	self.RUnlock()
+	if ok && current {
+		return parents
+	}
+
+	self.Lock()
+	defer self.Unlock()
+	if self.views == nil || self.serial != serial {
+		self.serial, self.views = serial, make(map[string]map[string]bool)
+	}
+	if parents, ok = self.views[view]; !ok {
+		parents = indexView(shaman.ListRecords(), view)
+		self.views[view] = parents
+	}
+	return parents
+}
+
+// rebuild re-indexes the views indexed so far, as the records have changed
+func (self *viewNames) rebuild() {
+	serial := shaman.Serial()
+	self.Lock()
+	defer self.Unlock()
+	if self.serial == serial {
+		return
+	}
+
+	resources := shaman.ListRecords()
+	views := make(map[string]map[string]bool, len(self.views))
+	for view := range self.views {
+		views[view] = indexView(resources, view)
+	}
+	self.serial, self.views = serial, views
+}
+
+// indexView returns the names the resources seen from view are beneath
+func indexView(resources []sham.Resource, view string) map[string]bool {
+	parents := make(map[string]bool)
+	for _, resource := range viewResources(resources, view) {
+		domain := strings.ToLower(dns.Fqdn(resource.Domain))
+		for domain != "." {
+			if domain = domain[strings.Index(domain, ".")+1:]; domain == "" {
+				domain = "."
+			}
+			parents[domain] = true
+		}
+	}
+	return parents
+}
+
+// GetViews returns the configured views and the domains answered in each
+func GetViews() []View {
+	views := make([]View, 0)
+	index := make(map[string]int)
+	for _, entry := range viewEntries {
+		i, ok := index[entry.name]
+		if !ok {
+			i = len(views)
+			index[entry.name] = i
+			views = append(views, View{Name: entry.name, Clients: make([]string, 0), Domains: make([]string, 0)})
+		}
+		views[i].Clients = append(views[i].Clients, entry.client)
+	}
+
+	resources := shaman.ListRecords()
+	for i := range views {
+		for _, resource := range viewResources(resources, views[i].Name) {
+			views[i].Domains = append(views[i].Domains, resource.Domain)
+		}
+		sort.Strings(views[i].Domains)
+	}
+	return views
+}
+
+// GetViewRecords returns the resources as answered in view
+func GetViewRecords(view string) []sham.Resource {
+	resources := viewResources(shaman.ListRecords(), strings.ToLower(view))
+	sort.Slice(resources, func(i, j int) bool { return resources[i].Domain < resources[j].Domain })
+	return resources
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/nanopack/shaman/config"
+	"github.com/nanopack/shaman/core"
+	sham "github.com/nanopack/shaman/core/common"
+)
+
+var errNoWildcard = errors.New("No wildcard matches")
+
+// wildcardRecord returns the wildcard resource that synthesizes answers for
+// name, following RFC 4592: only the wildcard directly beneath the closest
+// existing ancestor (the closest encloser) can match, and names that exist
+// (even as empty non-terminals) are never matched. Existence is as seen from
+// view.
+func wildcardRecord(name, view string) (sham.Resource, error) {
+	if existsInView(name, view) || hasSubdomainInView(name, view) {
+		return sham.Resource{}, errNoWildcard
+	}
+
+	for encloser := parent(name); encloser != ""; encloser = parent(encloser) {
+		// don't look above our own zone
+		if inZone(name) && !inZone(encloser) {
+			break
+		}
+		if !existsInView(encloser, view) && !hasSubdomainInView(encloser, view) {
+			continue
+		}
+
+		// the closest encloser is the only place a wildcard may come from
+		source := "*." + encloser
+		if encloser == "." {
+			source = "*."
+		}
+		config.Log.Trace("Checking wildcard '%v' for '%v'", source, name)
+		if !existsInView(source, view) {
+			break
+		}
+		return shaman.GetRecord(source)
+	}
+
+	return sham.Resource{}, errNoWildcard
+}
+
+// parent returns name with its first label removed ("" once past the root)
+func parent(name string) string {
+	if name == "." || name == "" {
+		return ""
+	}
+	i := strings.Index(name, ".")
+	if i < 0 || i == len(name)-1 {
+		return "."
+	}
+	return name[i+1:]
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/nanopack/shaman/config"
+	"github.com/nanopack/shaman/core"
+)
+
+// zone returns the (lowercased, rooted) zone shaman is authoritative for, or
+// an empty string if config.Domain is the root (not authoritative).
+func zone() string {
+	z := strings.ToLower(dns.Fqdn(config.Domain))
+	if z == "." {
+		return ""
+	}
+	return z
+}
+
+// inZone returns whether name falls within the authoritative zone
+func inZone(name string) bool {
+	z := zone()
+	return z != "" && dns.IsSubDomain(z, strings.ToLower(name))
+}
+
+// nameserver returns the zone's primary nameserver
+func nameserver() string {
+	if config.SoaNs == "" {
+		return "ns1." + zone()
+	}
+	return strings.ToLower(dns.Fqdn(config.SoaNs))
+}
+
+// hostmaster returns the zone's responsible mailbox in dns form
+// (`hostmaster@example.com` becomes `hostmaster.example.com.`)
+func hostmaster() string {
+	if config.SoaHostmaster == "" {
+		return "hostmaster." + zone()
+	}
+	return strings.ToLower(dns.Fqdn(strings.Replace(config.SoaHostmaster, "@", ".", 1)))
+}
+
+// soa returns the synthesized SOA record for the zone apex, its serial
+// incrementing with every change to the records
+func soa() dns.RR {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone(), Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: uint32(config.TTL)},
+		Ns:      nameserver(),
+		Mbox:    hostmaster(),
+		Serial:  shaman.Serial(),
+		Refresh: uint32(config.SoaRefresh),
+		Retry:   uint32(config.SoaRetry),
+		Expire:  uint32(config.SoaExpire),
+		Minttl:  uint32(config.SoaMinimum),
+	}
+}
+
+// ns returns the synthesized NS record for the zone apex
+func ns() dns.RR {
+	return &dns.NS{
+		Hdr: dns.RR_Header{Name: zone(), Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: uint32(config.TTL)},
+		Ns:  nameserver(),
+	}
+}
+
+// apexRecords returns the synthesized apex records matching qtype
+func apexRecords(qtype uint16) []dns.RR {
+	answers := make([]dns.RR, 0)
+	if qtype == dns.TypeSOA || qtype == dns.TypeANY {
+		answers = append(answers, soa())
+	}
+	if qtype == dns.TypeNS || qtype == dns.TypeANY {
+		answers = append(answers, ns())
+	}
+	if config.Dnssec && (qtype == dns.TypeDNSKEY || qtype == dns.TypeANY) {
+		answers = append(answers, dnskeys()...)
+	}
+	if config.Dnssec && config.DnssecDenial == "nsec3" && (qtype == dns.TypeNSEC3PARAM || qtype == dns.TypeANY) {
+		answers = append(answers, nsec3param())
+	}
+	return answers
+}